@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/spf13/cobra"
+)
+
+var approveOpts struct {
+	name string
+	uris []*url.URL
+}
+
+var approveCmd = &cobra.Command{
+	Use:     "approve <remote> [<fingerprint>...]",
+	Short:   "Approve new signers for a remote or list the signers",
+	Args:    cobra.MinimumNArgs(1),
+	PreRunE: approvePreRun,
+	RunE:    approveRun,
+}
+
+func init() {
+	rootCmd.AddCommand(approveCmd)
+}
+
+func approvePreRun(_ *cobra.Command, args []string) (err error) {
+	approveOpts.name, approveOpts.uris, err = resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(approveOpts.name, approveOpts.uris)
+}
+
+func approveRun(_ *cobra.Command, args []string) error {
+	return git.ApproveSigners(approveOpts.name, approveOpts.uris, rootOpts.cacheDir, args[1:])
+}
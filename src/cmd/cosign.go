@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/spf13/cobra"
+)
+
+var cosignOpts struct {
+	name string
+	uris []*url.URL
+}
+
+var cosignCmd = &cobra.Command{
+	Use:     "cosign <remote>",
+	Short:   "Add our signature to the bundles in a remote",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: cosignPreRun,
+	RunE:    cosignRun,
+}
+
+func init() {
+	rootCmd.AddCommand(cosignCmd)
+}
+
+func cosignPreRun(_ *cobra.Command, args []string) (err error) {
+	cosignOpts.name, cosignOpts.uris, err = resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(cosignOpts.name, cosignOpts.uris)
+}
+
+func cosignRun(_ *cobra.Command, _ []string) error {
+	return git.Cosign(cosignOpts.name, cosignOpts.uris, rootOpts.cacheDir)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/spf13/cobra"
+)
+
+var logOpts struct {
+	name string
+	uris []*url.URL
+}
+
+var logCmd = &cobra.Command{
+	Use:     "log <remote>",
+	Short:   "Show and verify the push history of a remote",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: logPreRun,
+	RunE:    logRun,
+}
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+}
+
+func logPreRun(_ *cobra.Command, args []string) (err error) {
+	logOpts.name, logOpts.uris, err = resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(logOpts.name, logOpts.uris)
+}
+
+func logRun(_ *cobra.Command, _ []string) error {
+	return git.History(logOpts.name, logOpts.uris, rootOpts.cacheDir)
+}
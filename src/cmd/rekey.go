@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/spf13/cobra"
+)
+
+var rekeyOpts struct {
+	name string
+	uris []*url.URL
+}
+
+var rekeyCmd = &cobra.Command{
+	Use:     "rekey <remote>",
+	Short:   "Re-seal a remote for the current keyring",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: rekeyPreRun,
+	RunE:    rekeyRun,
+}
+
+func init() {
+	rootCmd.AddCommand(rekeyCmd)
+}
+
+func rekeyPreRun(_ *cobra.Command, args []string) (err error) {
+	rekeyOpts.name, rekeyOpts.uris, err = resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(rekeyOpts.name, rekeyOpts.uris)
+}
+
+func rekeyRun(_ *cobra.Command, _ []string) error {
+	return git.Rekey(rekeyOpts.name, rekeyOpts.uris, rootOpts.cacheDir)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/spf13/cobra"
+)
+
+var restoreOpts struct {
+	generation int
+	version    uint64
+	name       string
+	uris       []*url.URL
+}
+
+var restoreCmd = &cobra.Command{
+	Use:     "restore <remote>",
+	Short:   "Republish a previous generation or version of a remote",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: restorePreRun,
+	RunE:    restoreRun,
+}
+
+func init() {
+	flags := restoreCmd.Flags()
+
+	flags.IntVarP(&restoreOpts.generation, "generation", "g", 1,
+		"Generation to restore (1 is the chain before the current one)")
+	flags.Uint64VarP(&restoreOpts.version, "at", "", 0,
+		"Version in the current chain to restore instead of a generation")
+
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func restorePreRun(_ *cobra.Command, args []string) (err error) {
+	restoreOpts.name, restoreOpts.uris, err = resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(restoreOpts.name, restoreOpts.uris)
+}
+
+func restoreRun(_ *cobra.Command, _ []string) error {
+	return git.Restore(restoreOpts.name, restoreOpts.uris, rootOpts.cacheDir, restoreOpts.generation,
+		restoreOpts.version)
+}
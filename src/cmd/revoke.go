@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var revokeOpts struct {
+	time    string
+	reason  string
+	publish string
+	revoked time.Time
+	uris    []*url.URL
+}
+
+var revokeCmd = &cobra.Command{
+	Use:     "revoke [<fingerprint>...]",
+	Short:   "Revoke keys or list the revoked keys",
+	PreRunE: revokePreRun,
+	RunE:    revokeRun,
+}
+
+func init() {
+	flags := revokeCmd.Flags()
+
+	flags.StringVarP(&revokeOpts.time, "time", "t", "",
+		"Reject blobs signed at or after this time (RFC 3339, default now)")
+	flags.StringVarP(&revokeOpts.reason, "reason", "r", "", "Reason for the revocation")
+	flags.StringVarP(&revokeOpts.publish, "publish", "p", "",
+		"Publish the revocation list to a remote")
+
+	rootCmd.AddCommand(revokeCmd)
+}
+
+func revokePreRun(_ *cobra.Command, _ []string) (err error) {
+	revokeOpts.revoked = time.Now()
+	if revokeOpts.time != "" {
+		revokeOpts.revoked, err = time.Parse(time.RFC3339, revokeOpts.time)
+		if err != nil {
+			return errors.Wrap(err, "--time")
+		}
+	}
+
+	path, err := git.RevocationsPath()
+	if err != nil {
+		return err
+	}
+
+	if path != "" {
+		err = rootOpts.Sandbox.AddReadWritePath(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+	}
+
+	if revokeOpts.publish == "" {
+		return rootOpts.Sandbox.Confine()
+	}
+
+	_, revokeOpts.uris, err = resolveRemote(revokeOpts.publish)
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(revokeOpts.publish, revokeOpts.uris)
+}
+
+func revokeRun(_ *cobra.Command, args []string) error {
+	return git.Revoke(args, revokeOpts.revoked, revokeOpts.reason, revokeOpts.publish, revokeOpts.uris)
+}
@@ -32,6 +32,13 @@ var rootCmd = &cobra.Command{
 	Version: metadata.Version(),
 	Args:    cobra.ExactArgs(2),
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// The arguments of subcommands have been validated by now, so
+		// their errors aren't usage errors.  The helper itself is
+		// handled in rootRun.
+		if cmd.HasParent() {
+			cmd.SilenceUsage = true
+		}
+
 		err := rootPreRun(cmd, args)
 		if err != nil {
 			log.Tracef("%+v", err)
@@ -109,45 +116,78 @@ func rootPreRun(_ *cobra.Command, _ []string) error {
 
 // This function is reached when invoked through `git` or if the user manually
 // executes `git-remote-bundle` on the CLI without specifying a subcommand.
-func rootRun(_ *cobra.Command, args []string) error {
+func rootRun(cmd *cobra.Command, args []string) error {
 	// The GIT_DIR and GIT_EXEC_PATH environment variables are set when Git
 	// executes the helper.
 	if os.Getenv("GIT_DIR") == "" || os.Getenv("GIT_EXEC_PATH") == "" {
 		return errors.Errorf("not invoked as a remote helper by git")
 	}
 
-	ro, rw, err := sshx.SandboxPaths()
+	// Errors from here on are reported to the user of Git, who didn't
+	// invoke the helper with any arguments.
+	cmd.SilenceUsage = true
+
+	uri, err := url.Parse(args[1])
 	if err != nil {
 		return err
 	}
 
-	uri, err := url.Parse(args[1])
+	uris, err := git.RemoteURLs(args[0], uri)
 	if err != nil {
 		return err
 	}
 
-	if uri.Scheme == "file" {
-		rw = append(rw, uri.Path)
+	rootOpts.Sandbox.SetStdin(os.Stdin)
+	rootOpts.Sandbox.SetStdout(process.UnsafeByteOutput)
+
+	err = confineRemote(args[0], uris)
+	if err != nil {
+		return err
 	}
 
-	err = rootOpts.Sandbox.AddReadOnlyPath(ro...)
+	return git.Communicate(args[0], uris, rootOpts.cacheDir)
+}
+
+// Resolve a remote name or URL given on the command line to the name and
+// URLs of the remote.
+func resolveRemote(remote string) (string, []*url.URL, error) {
+	uri, err := git.RemoteURL(remote)
+	if err != nil {
+		return "", nil, err
+	}
+
+	uris, err := git.RemoteURLs(remote, uri)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return remote, uris, nil
+}
+
+// Confine the sandbox with access to the URLs and the keys of a remote.
+func confineRemote(name string, uris []*url.URL) error {
+	ro, rw, err := sshx.SandboxPaths()
 	if err != nil {
 		return err
 	}
 
-	err = rootOpts.Sandbox.AddReadWritePath(rw...)
+	remoteRO, remoteRW, err := git.RemoteSandboxPaths(name, uris)
 	if err != nil {
 		return err
 	}
+	ro = append(ro, remoteRO...)
+	rw = append(rw, remoteRW...)
 
-	rootOpts.Sandbox.SetStdin(os.Stdin)
-	rootOpts.Sandbox.SetStdout(process.UnsafeByteOutput)
-	rootOpts.Sandbox.SetShareNet(true)
+	err = rootOpts.Sandbox.AddReadOnlyPath(ro...)
+	if err != nil {
+		return err
+	}
 
-	err = rootOpts.Sandbox.Confine()
+	err = rootOpts.Sandbox.AddReadWritePath(rw...)
 	if err != nil {
 		return err
 	}
 
-	return git.Communicate(uri, rootOpts.cacheDir)
+	rootOpts.Sandbox.SetShareNet(true)
+	return rootOpts.Sandbox.Confine()
 }
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net/url"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+
+	"github.com/spf13/cobra"
+)
+
+var setHeadOpts struct {
+	name string
+	uris []*url.URL
+}
+
+var setHeadCmd = &cobra.Command{
+	Use:     "set-head <remote> <branch>",
+	Short:   "Set the default branch of a remote",
+	Args:    cobra.ExactArgs(2),
+	PreRunE: setHeadPreRun,
+	RunE:    setHeadRun,
+}
+
+func init() {
+	rootCmd.AddCommand(setHeadCmd)
+}
+
+func setHeadPreRun(_ *cobra.Command, args []string) (err error) {
+	setHeadOpts.name, setHeadOpts.uris, err = resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+
+	return confineRemote(setHeadOpts.name, setHeadOpts.uris)
+}
+
+func setHeadRun(_ *cobra.Command, args []string) error {
+	return git.SetHead(setHeadOpts.name, setHeadOpts.uris, rootOpts.cacheDir, args[1])
+}
@@ -1,18 +1,21 @@
 package git
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/illikainen/go-utils/src/errorx"
-	"github.com/illikainen/go-utils/src/iofs"
 	"github.com/illikainen/go-utils/src/stringx"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+var ErrEmptyBundle = errors.New("empty bundle")
+
 // Clone a bundle.
 //
 // If `merge.verifySignatures` is true in .gitconfig, the references in `dir`
@@ -28,59 +31,365 @@ func cloneBundle(bundle string, dir string) (err error) {
 		panic("bug")
 	}
 
-	tmpDir, tmpClean, err := iofs.MkdirTemp()
+	// The repository is cloned next to `dir` so that it can be renamed
+	// without crossing filesystems.
+	tmpRepo := dir + ".tmp"
+	err = os.RemoveAll(tmpRepo)
 	if err != nil {
 		return err
 	}
-	defer errorx.Defer(tmpClean, &err)
+	defer errorx.Defer(func() error { return os.RemoveAll(tmpRepo) }, &err)
 
-	tmpRepo := filepath.Join(tmpDir, "repo")
-	cloneCmd := exec.Command("git", "clone", "--bare", "--mirror", bundle, tmpRepo)
+	cloneCmd := exec.Command("git", "clone", "--quiet", "--bare", "--mirror", bundle, tmpRepo)
 	err = cloneCmd.Run()
 	if err != nil {
 		return err
 	}
 
-	verifySignatures, err := VerifyMergeSignatures()
+	err = verifyRefs(tmpRepo)
 	if err != nil {
 		return err
 	}
 
-	if verifySignatures {
-		showRefCmd := exec.Command("git", "--git-dir", tmpRepo, "show-ref")
-		showRef, err := showRefCmd.Output()
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpRepo, dir)
+}
+
+// Apply an incremental bundle or the refs in another repository on top of the
+// repository in `dir`.
+//
+// An incremental bundle only includes the refs that were updated when it was
+// created, so the refs in `dir` are reconciled with `refs` afterwards to
+// handle deletions and refs that were moved to existing commits.
+func applyBundle(src string, dir string, refs map[string]string) error {
+	log.Tracef("applying %s to %s", src, dir)
+
+	if !strings.HasPrefix(src, "/") {
+		panic("bug")
+	}
+
+	out, err := exec.Command("git", "--git-dir", dir, "fetch", "--quiet", "--no-write-fetch-head",
+		src, "+refs/*:refs/*").CombinedOutput()
+	if err != nil {
+		return errors.Errorf("%s: %v", strings.TrimRight(string(out), "\r\n"), err)
+	}
+
+	if refs != nil {
+		current, err := showRefs(dir)
 		if err != nil {
 			return err
 		}
 
-		showRefLines := stringx.SplitLines(string(showRef))
-		if len(showRefLines) == 0 {
-			return errors.Errorf("%s has no refs", bundle)
+		stdin := bytes.Buffer{}
+		for ref := range current {
+			if _, ok := refs[ref]; !ok {
+				log.Debugf("delete %s", ref)
+				stdin.WriteString(fmt.Sprintf("delete %s\n", ref))
+			}
 		}
 
-		for _, line := range stringx.SplitLines(string(showRef)) {
-			elts := strings.Split(line, " ")
-			if len(elts) != 2 || len(elts[0]) != 40 || !strings.HasPrefix(elts[1], "refs/") {
-				return errors.Errorf("invalid show-ref line: %s", line)
+		for ref, oid := range refs {
+			if current[ref] != oid {
+				log.Debugf("update %s to %s", ref, oid)
+				stdin.WriteString(fmt.Sprintf("update %s %s\n", ref, oid))
 			}
+		}
 
-			verifyCmd := &exec.Cmd{}
-			if strings.HasPrefix(elts[1], "refs/tags/") {
-				log.Debugf("verify tag %s (%s)", elts[0], elts[1])
-				verifyCmd = exec.Command("git", "--git-dir", tmpRepo, "verify-tag", elts[0])
-			} else {
-				log.Debugf("verify commit %s (%s)", elts[0], elts[1])
-				verifyCmd = exec.Command("git", "--git-dir", tmpRepo, "verify-commit", elts[0])
+		if stdin.Len() > 0 {
+			updateRef := exec.Command("git", "--git-dir", dir, "update-ref", "--stdin")
+			updateRef.Stdin = &stdin
+			out, err := updateRef.CombinedOutput()
+			if err != nil {
+				return errors.Errorf("%s: %v", strings.TrimRight(string(out), "\r\n"), err)
 			}
+		}
+	}
 
-			verify, err := verifyCmd.CombinedOutput()
-			if err != nil {
-				return errors.Errorf("%s: %v", strings.TrimRight(string(verify), "\r\n"), err)
+	return verifyRefs(dir)
+}
+
+// Create a bundle with the refs in `refs` from `repo`.
+//
+// If `exclude` isn't empty, an incremental bundle is created with the objects
+// in `exclude` as prerequisites.  Git refuses to create an incremental bundle
+// without any new objects, in which case ErrEmptyBundle is returned.
+func createBundle(repo string, path string, refs map[string]string, exclude []string) error {
+	stdin := bytes.Buffer{}
+	for _, ref := range sortedRefs(refs) {
+		stdin.WriteString(ref + "\n")
+	}
+
+	for _, oid := range exclude {
+		stdin.WriteString("^" + oid + "\n")
+	}
+
+	bundleCmd := exec.Command("git", "--git-dir", repo, "bundle", "create", "--quiet", path, "--stdin")
+	bundleCmd.Stdin = &stdin
+	out, err := bundleCmd.CombinedOutput()
+	if err != nil {
+		if len(exclude) > 0 && strings.Contains(string(out), "empty bundle") {
+			return ErrEmptyBundle
+		}
+		return errors.Errorf("%s: %v", strings.TrimRight(string(out), "\r\n"), err)
+	}
+
+	return nil
+}
+
+// Verify the refs in `repo` if `merge.verifySignatures` is enabled.
+//
+// See cloneBundle().
+func verifyRefs(repo string) error {
+	verifySignatures, err := VerifyMergeSignatures()
+	if err != nil {
+		return err
+	}
+
+	if !verifySignatures {
+		return nil
+	}
+
+	showRefCmd := exec.Command("git", "--git-dir", repo, "show-ref")
+	showRef, err := showRefCmd.Output()
+	if err != nil {
+		return err
+	}
+
+	showRefLines := stringx.SplitLines(string(showRef))
+	if len(showRefLines) == 0 {
+		return errors.Errorf("%s has no refs", repo)
+	}
+
+	format, err := objectFormat(repo)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range showRefLines {
+		elts := strings.Split(line, " ")
+		if len(elts) != 2 || !validOID(elts[0], format) || !strings.HasPrefix(elts[1], "refs/") {
+			return errors.Errorf("invalid show-ref line: %s", line)
+		}
+
+		verifyCmd := &exec.Cmd{}
+		if strings.HasPrefix(elts[1], "refs/tags/") {
+			log.Debugf("verify tag %s (%s)", elts[0], elts[1])
+			verifyCmd = exec.Command("git", "--git-dir", repo, "verify-tag", elts[0])
+		} else {
+			log.Debugf("verify commit %s (%s)", elts[0], elts[1])
+			verifyCmd = exec.Command("git", "--git-dir", repo, "verify-commit", elts[0])
+		}
+
+		verify, err := verifyCmd.CombinedOutput()
+		if err != nil {
+			return errors.Errorf("%s: %v", strings.TrimRight(string(verify), "\r\n"), err)
+		}
+
+		log.Infof("%s", verify)
+	}
+
+	return nil
+}
+
+// Retrieve every ref in `repo`.
+func showRefs(repo string) (map[string]string, error) {
+	refs := map[string]string{}
+
+	out, err := exec.Command("git", "--git-dir", repo, "show-ref").Output()
+	if err != nil {
+		// show-ref exits with 1 if there are no refs.
+		exit, ok := err.(*exec.ExitError)
+		if ok && exit.ExitCode() == 1 {
+			return refs, nil
+		}
+		return nil, err
+	}
+
+	for _, line := range stringx.SplitLines(string(out)) {
+		elts := strings.Split(line, " ")
+		if len(elts) != 2 || !strings.HasPrefix(elts[1], "refs/") {
+			return nil, errors.Errorf("invalid show-ref line: %s", line)
+		}
+		refs[elts[1]] = elts[0]
+	}
+
+	return refs, nil
+}
+
+func equalRefs(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for ref, oid := range a {
+		if b[ref] != oid {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Retrieve the refs in `refs` that match any of the patterns in `patterns`.
+//
+// A pattern is either the full name of a ref or a name with a single `*` that
+// matches any sequence of characters (including `/`), as in a refspec.
+func filterRefs(refs map[string]string, patterns []string) map[string]string {
+	filtered := map[string]string{}
+	for ref, oid := range refs {
+		for _, pattern := range patterns {
+			if matchRef(ref, pattern) {
+				filtered[ref] = oid
+				break
 			}
+		}
+	}
+	return filtered
+}
+
+func matchRef(ref string, pattern string) bool {
+	prefix, suffix, glob := strings.Cut(pattern, "*")
+	if !glob {
+		return ref == pattern
+	}
 
-			log.Infof("%s", verify)
+	return len(ref) >= len(prefix)+len(suffix) && strings.HasPrefix(ref, prefix) &&
+		strings.HasSuffix(ref, suffix)
+}
+
+func sortedRefs(refs map[string]string) []string {
+	names := []string{}
+	for ref := range refs {
+		names = append(names, ref)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Retrieve the unique objects that the refs in `refs` point to.
+func refObjects(refs map[string]string) []string {
+	seen := map[string]bool{}
+	oids := []string{}
+
+	for _, oid := range refs {
+		if !seen[oid] {
+			seen[oid] = true
+			oids = append(oids, oid)
 		}
 	}
 
-	return os.Rename(tmpRepo, dir)
+	sort.Strings(oids)
+	return oids
+}
+
+// Retrieve the objects that the annotated tags among `chainRefs` in `repo`
+// point to.
+func peeledRefs(repo string, chainRefs map[string]string) (map[string]string, error) {
+	refs := map[string]string{}
+
+	out, err := exec.Command("git", "--git-dir", repo, "show-ref", "--dereference").Output()
+	if err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if ok && exit.ExitCode() == 1 {
+			return refs, nil
+		}
+		return nil, err
+	}
+
+	for _, line := range stringx.SplitLines(string(out)) {
+		elts := strings.Split(line, " ")
+		if len(elts) != 2 || !strings.HasPrefix(elts[1], "refs/") {
+			return nil, errors.Errorf("invalid show-ref line: %s", line)
+		}
+
+		ref := strings.TrimSuffix(elts[1], "^{}")
+		if _, ok := chainRefs[ref]; ok && ref != elts[1] {
+			refs[ref] = elts[0]
+		}
+	}
+
+	return refs, nil
+}
+
+// Retrieve the ref that HEAD in `repo` points to.
+func headRef(repo string) (string, error) {
+	out, err := exec.Command("git", "--git-dir", repo, "symbolic-ref", "--quiet", "HEAD").Output()
+	if err != nil {
+		// symbolic-ref exits with 1 if HEAD is detached.
+		exit, ok := err.(*exec.ExitError)
+		if ok && exit.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// Point HEAD in `repo` at `ref` if it's one of the refs in `refs`.
+func setHead(repo string, ref string, refs map[string]string) error {
+	if _, ok := refs[ref]; !ok {
+		return nil
+	}
+
+	out, err := exec.Command("git", "--git-dir", repo, "symbolic-ref", "HEAD", ref).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("%s: %v", strings.TrimRight(string(out), "\r\n"), err)
+	}
+
+	return nil
+}
+
+// Retrieve the object format of `repo`, or of the repository that the helper
+// was invoked for if `repo` is empty.
+func objectFormat(repo string) (string, error) {
+	args := []string{"rev-parse", "--show-object-format"}
+	if repo != "" {
+		args = append([]string{"--git-dir", repo}, args...)
+	}
+
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("%s: %v", strings.TrimRight(string(out), "\r\n"), err)
+	}
+
+	format := strings.TrimRight(string(out), "\r\n")
+	if oidLength(format) == 0 {
+		return "", errors.Errorf("unsupported object format: %s", format)
+	}
+
+	return format, nil
+}
+
+// The number of hex digits in an object ID for `format`.  Zero is returned
+// for unsupported formats.
+func oidLength(format string) int {
+	switch format {
+	case "sha1":
+		return 40
+	case "sha256":
+		return 64
+	default:
+		return 0
+	}
+}
+
+// Whether `oid` is an object ID in `format`.
+func validOID(oid string, format string) bool {
+	if oidLength(format) == 0 || len(oid) != oidLength(format) {
+		return false
+	}
+
+	for _, c := range oid {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
 }
@@ -0,0 +1,126 @@
+package git
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidOID(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	sha256 := strings.Repeat("0123456789abcdef", 4)
+
+	tests := []struct {
+		oid    string
+		format string
+		valid  bool
+	}{
+		{sha1, "sha1", true},
+		{sha256, "sha256", true},
+		{sha1, "sha256", false},
+		{sha256, "sha1", false},
+		{sha1, "", false},
+		{strings.Repeat("A", 40), "sha1", false},
+		{strings.Repeat("g", 40), "sha1", false},
+		{sha1[1:], "sha1", false},
+	}
+
+	for _, test := range tests {
+		if validOID(test.oid, test.format) != test.valid {
+			t.Errorf("%s in %s: expected %v", test.oid, test.format, test.valid)
+		}
+	}
+}
+
+func TestHeaderOIDs(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	sha256 := strings.Repeat("b", 64)
+
+	tests := []struct {
+		hdr   *Header
+		valid bool
+	}{
+		{&Header{Refs: map[string]string{"refs/heads/main": sha1}}, true},
+		{&Header{ObjectFormat: "sha1", Refs: map[string]string{"refs/heads/main": sha256}}, false},
+		{&Header{ObjectFormat: "sha256", Refs: map[string]string{"refs/heads/main": sha256}}, true},
+		{&Header{ObjectFormat: "sha256", Refs: map[string]string{"refs/heads/main": sha1}}, false},
+		{&Header{ObjectFormat: "sha256", Updates: []*RefUpdate{{Ref: "refs/heads/main", New: sha256}}}, true},
+		{&Header{ObjectFormat: "sha256", Updates: []*RefUpdate{{Ref: "refs/heads/main", Old: sha1}}}, false},
+	}
+
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		test.hdr.Format = HeaderFormat
+		err := writeHeader(buf, test.hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = readHeader(buf)
+		if (err == nil) != test.valid || (err != nil && !errors.Is(err, ErrInvalidHeader)) {
+			t.Errorf("%d: expected valid=%v, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestMatchRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		pattern string
+		match   bool
+	}{
+		{"refs/heads/main", "refs/heads/main", true},
+		{"refs/heads/main", "refs/heads/mai", false},
+		{"refs/heads/main", "refs/heads/*", true},
+		{"refs/heads/a/b", "refs/heads/*", true},
+		{"refs/tags/v1", "refs/heads/*", false},
+		{"refs/heads/x-test", "refs/heads/*-test", true},
+		{"refs/heads/-test", "refs/heads/*-test", true},
+		{"refs/heads/test", "refs/heads/*-test", false},
+		{"refs/heads/ab", "refs/heads/a*b", true},
+		{"refs/heads/a", "refs/heads/a*a", false},
+	}
+
+	for _, test := range tests {
+		if matchRef(test.ref, test.pattern) != test.match {
+			t.Errorf("%s with %s: expected %v", test.ref, test.pattern, test.match)
+		}
+	}
+}
+
+func TestFilterRefs(t *testing.T) {
+	refs := map[string]string{
+		"refs/heads/main":   "1",
+		"refs/heads/wip/x":  "2",
+		"refs/tags/v1":      "3",
+		"refs/notes/commit": "4",
+	}
+
+	tests := []struct {
+		patterns []string
+		expected map[string]string
+	}{
+		{
+			patterns: []string{"refs/heads/*", "refs/tags/*"},
+			expected: map[string]string{"refs/heads/main": "1", "refs/heads/wip/x": "2", "refs/tags/v1": "3"},
+		},
+		{
+			patterns: []string{"refs/heads/main", "refs/notes/*"},
+			expected: map[string]string{"refs/heads/main": "1", "refs/notes/commit": "4"},
+		},
+		{
+			patterns: nil,
+			expected: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		filtered := filterRefs(refs, test.patterns)
+		if !reflect.DeepEqual(filtered, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.patterns, test.expected, filtered)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/pkg/errors"
+)
+
+// Cache is the local cache of sealed blobs and verified state for every
+// remote.
+//
+// Each remote gets its own directory named after the SHA2-256 of its
+// normalized URL, so remotes with the same basename don't clobber each other.
+// The index in the cache directory maps each of those directories back to
+// its URL together with information about the last verified bundle.
+type Cache struct {
+	Dir string
+}
+
+type CacheEntry struct {
+	URL     string
+	Hash    string
+	Signer  string
+	Fetched int64
+}
+
+const cacheIndex = "index.json"
+
+func NewCache(dir string) (*Cache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cache{Dir: dir}, nil
+}
+
+// Retrieve the cache directory for `uri`, creating it if necessary.
+func (c *Cache) RemoteDir(uri *url.URL) (string, error) {
+	dir := filepath.Join(c.Dir, cacheKey(uri))
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func (c *Cache) ReadIndex() (map[string]*CacheEntry, error) {
+	index := map[string]*CacheEntry{}
+
+	data, err := os.ReadFile(filepath.Join(c.Dir, cacheIndex))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return index, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, errors.Wrap(err, cacheIndex)
+	}
+
+	return index, nil
+}
+
+// Record the last verified bundle for `uri` in the index.
+func (c *Cache) Record(uri *url.URL, hash string, signer string) (err error) {
+	timeout, err := LockTimeout()
+	if err != nil {
+		return err
+	}
+
+	lock, err := LockFile(filepath.Join(c.Dir, cacheIndex+".lock"), timeout)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(lock.Unlock, &err)
+
+	index, err := c.ReadIndex()
+	if err != nil {
+		return err
+	}
+
+	index[cacheKey(uri)] = &CacheEntry{
+		URL:     NormalizeURL(uri),
+		Hash:    hash,
+		Signer:  signer,
+		Fetched: time.Now().Unix(),
+	}
+
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(c.Dir, cacheIndex+".tmp")
+	err = os.WriteFile(tmp, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(c.Dir, cacheIndex))
+}
+
+// Normalize `uri` so that equivalent URLs map to the same cache entry.
+//
+// The scheme and host are lowercased, the path is cleaned and any password is
+// removed.
+func NormalizeURL(uri *url.URL) string {
+	norm := url.URL{
+		Scheme: strings.ToLower(uri.Scheme),
+		Host:   strings.ToLower(uri.Host),
+		Path:   uri.Path,
+	}
+
+	if uri.User != nil {
+		norm.User = url.User(uri.User.Username())
+	}
+
+	if norm.Path != "" {
+		norm.Path = path.Clean(norm.Path)
+	}
+
+	return norm.String()
+}
+
+func cacheKey(uri *url.URL) string {
+	sum := sha256.Sum256([]byte(NormalizeURL(uri)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,329 @@
+package git
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-netutils/src/transport"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Chain describes the sealed bundles that a remote repository is assembled
+// from.
+//
+// A push uploads an incremental bundle with the previous tips as prerequisites
+// to `<url>.inc.<n>`, where `n` is the position of the bundle in the chain.
+// Once `bundle.consolidate` incremental bundles have been pushed, the next push
+// uploads a full bundle to `<url>` and a new chain is started.
+//
+// Incremental bundles from a previous chain are left as-is on the remote
+// because the transports have no way of removing files.  They're ignored when
+// the chain is replayed because their headers refer to another full bundle.
+type Chain struct {
+	// Identifier of the repository.
+	Repository string
+
+	// SHA2-256 of the sealed full bundle.
+	Base string
+
+	// SHA2-256 of the last sealed bundle in the chain.
+	Tip string
+
+	// Fingerprint of the key that signed the tip.
+	Signer string
+
+	// Number of incremental bundles on top of the full bundle.
+	Length int
+
+	// Version and creation time of the tip.
+	Version   uint64
+	Timestamp int64
+
+	// Object format of the repository.
+	ObjectFormat string
+
+	// HEAD and refs at the tip of the chain.
+	Head string
+	Refs map[string]string
+
+	// SHA2-256 of the sealed bundle that occupied the position after the
+	// tip when the chain was downloaded.  Empty if the position was free.
+	Next string
+}
+
+var ErrConcurrentUpdate = errors.New("the remote was updated by another push; fetch first")
+
+func incrementalURL(uri *url.URL, index int) *url.URL {
+	inc := *uri
+	inc.Path = fmt.Sprintf("%s.inc.%d", uri.Path, index)
+	inc.RawPath = ""
+	return &inc
+}
+
+// Verify that the remote still looks like it did when `chain` was downloaded.
+//
+// This is used as a compare-and-swap right before uploading a new bundle in
+// order to reject pushes that would discard a concurrent push.  The push is
+// reported to Git as rejected with "fetch first", as if the remote had moved
+// before the push started (see report).  Note that the transports have no
+// atomic operations, so there's a small window between the check and the
+// upload.
+//
+// The remote is compared with the hashes in the unverified metadata of the
+// blobs (see remoteHash).  That's enough to detect a change, and a host that
+// lies about the hashes can only make the push fail or overwrite bundles that
+// it could have removed anyway.  Everything that's downloaded is verified
+// before it's used.
+func checkRemote(r *remote, uri *url.URL, chain *Chain) error {
+	diff, err := diffRemote(r, uri, chain)
+	if err != nil {
+		return err
+	}
+
+	if diff != "" {
+		return errors.Wrap(ErrConcurrentUpdate, diff)
+	}
+
+	return nil
+}
+
+// Compare the remote with `chain` without downloading any bundles.
+//
+// The full bundle, the tip and the position after the tip are compared.  The
+// hashes of the incremental bundles commit to their parents, so the rest of
+// the chain is unchanged if these are.
+//
+// A description of the first difference is returned if the remote has
+// changed.  A nil `chain` means that the remote shouldn't exist.
+func diffRemote(r *remote, uri *url.URL, chain *Chain) (string, error) {
+	type expectation struct {
+		uri  *url.URL
+		hash string
+	}
+
+	expected := []expectation{{uri, ""}}
+	if chain != nil {
+		expected = []expectation{{uri, chain.Base}}
+		if chain.Length > 0 {
+			expected = append(expected, expectation{incrementalURL(uri, chain.Length), chain.Tip})
+		}
+		expected = append(expected, expectation{incrementalURL(uri, chain.Length+1), chain.Next})
+	}
+
+	for _, cur := range expected {
+		hash, err := r.remoteHash(cur.uri)
+		if err != nil {
+			return "", err
+		}
+
+		if hash != cur.hash {
+			return fmt.Sprintf("%s changed from '%s' to '%s'", cur.uri, cur.hash, hash), nil
+		}
+	}
+
+	return "", nil
+}
+
+func readChain(path string) (*Chain, error) {
+	data, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	chain := &Chain{}
+	err = json.Unmarshal(data, chain)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	return chain, nil
+}
+
+func writeChain(path string, chain *Chain) error {
+	data, err := json.Marshal(chain)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Retrieve the SHA2-256 of a sealed blob on the remote without downloading
+// it.
+//
+// The signature isn't verified, so the hash may only be used to detect whether
+// the blob has changed.  An empty string is returned if the blob doesn't
+// exist.
+func (r *remote) remoteHash(uri *url.URL) (hash string, err error) {
+	xfer, err := r.transport(uri)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := xfer.Open(uri.Path)
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer errorx.Defer(reader.Close, &err)
+
+	size := uint32(0)
+	err = binary.Read(reader, binary.BigEndian, &size)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if size == 0 || size > maxMetadataSize {
+		return "", errors.Errorf("%s: invalid metadata size: %d", uri, size)
+	}
+
+	data := make([]byte, size)
+	err = iofs.ReadFull(reader, data)
+	if err != nil {
+		return "", err
+	}
+
+	meta := struct {
+		Hashes struct {
+			SHA256 string
+		}
+	}{}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return "", err
+	}
+
+	return meta.Hashes.SHA256, nil
+}
+
+const maxMetadataSize = 1024 * 1024
+
+func incrementalFile(bundleFile *os.File, index int) (*os.File, error) {
+	return os.OpenFile(fmt.Sprintf("%s.inc.%d", bundleFile.Name(), index), os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// Read the header from the payload of a verified blob.
+func blobHeader(bundle *blob.Reader) (*Header, error) {
+	_, err := iofs.Seek(bundle, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, _, err := readHeader(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
+// Write the header and the Git bundle in the payload of a verified blob to
+// `path`.
+func extractBundle(bundle *blob.Reader, path string) (hdr *Header, err error) {
+	_, err = iofs.Seek(bundle, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, reader, err := readHeader(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer errorx.Defer(f.Close, &err)
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
+// Seal the Git bundle in `path` together with `hdr` and write the result to
+// `sealed`.
+func sealBundle(sealed *os.File, hdr *Header, path string, keys *blob.Keyring) (err error) {
+	bundle, err := os.Open(path) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(bundle.Close, &err)
+
+	_, err = iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = sealed.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	writer, err := blob.NewWriter(sealed, &blob.Options{
+		Type:      metadata.Name(),
+		Keyring:   keys,
+		Encrypted: Encrypt(),
+	})
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(writer.Close, &err)
+
+	hdr.Format = HeaderFormat
+	err = writeHeader(writer, hdr)
+	if err != nil {
+		return err
+	}
+
+	err = iofs.Copy(writer, bundle)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Sign()
+	if err != nil {
+		return err
+	}
+
+	return sealed.Sync()
+}
+
+func logBlob(name string, bundle *blob.Reader) {
+	log.Infof("%s: signed by %s", name, bundle.Signer)
+	log.Infof("%s: sha2-256: %s", name, bundle.Metadata.Hashes.SHA256)
+	log.Infof("%s: sha3-512: %s", name, bundle.Metadata.Hashes.KECCAK512)
+	log.Infof("%s: blake2b-512: %s", name, bundle.Metadata.Hashes.BLAKE2b512)
+}
@@ -0,0 +1,63 @@
+package git
+
+import (
+	"encoding/binary"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/illikainen/go-netutils/src/transport"
+)
+
+func TestRemoteHash(t *testing.T) {
+	dir := t.TempDir()
+	meta := []byte(`{"Hashes":{"SHA256":"abc"}}`)
+
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(meta)))
+	err := os.WriteFile(filepath.Join(dir, "repo"), append(data, meta...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "empty"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &remote{xfers: map[string]transport.Transport{}}
+	for name, expected := range map[string]string{"repo": "abc", "empty": "", "missing": ""} {
+		hash, err := r.remoteHash(&url.URL{Scheme: "file", Path: filepath.Join(dir, name)})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if hash != expected {
+			t.Errorf("%s: expected '%s', got '%s'", name, expected, hash)
+		}
+	}
+
+	// Every URL on the same host shares a transport.
+	if len(r.xfers) != 1 {
+		t.Errorf("expected 1 transport, got %d", len(r.xfers))
+	}
+
+	a, err := r.transport(&url.URL{Scheme: "http", Host: "example.com", Path: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := r.transport(&url.URL{Scheme: "http", Host: "example.com", Path: "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := r.transport(&url.URL{Scheme: "http", Host: "example.org", Path: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a != b || a == c || len(r.xfers) != 3 {
+		t.Errorf("unexpected transports: %v", r.xfers)
+	}
+}
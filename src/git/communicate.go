@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/illikainen/git-remote-bundle/src/metadata"
 
@@ -23,37 +25,90 @@ import (
 var ErrMissingArguments = errors.New("missing arguments")
 var ErrInvalidCommand = errors.New("invalid command")
 
-func Communicate(uri *url.URL, cacheDir string) (err error) {
-	keys, err := ReadKeyring()
-	if err != nil {
-		return err
-	}
+// State shared by the commands that operate on a remote.
+type remote struct {
+	name string
+
+	// URL that is currently operated on and every URL of the remote.
+	uri  *url.URL
+	uris []*url.URL
+
+	keys       *blob.Keyring
+	cache      *Cache
+	dir        string
+	lock       *Lock
+	bundleFile *os.File
+
+	// Patterns for the refs that are included in pushed bundles.
+	refs []string
+
+	// Refs that each signer is allowed to change.
+	policy Policy
+
+	// Patterns for the refs that can't be deleted or force-pushed.
+	protected []string
+
+	// Number of keys that must sign each bundle.
+	threshold int
+
+	// How to handle bundles from signers that haven't been approved, and
+	// whether every signer is approved because the signers of the remote
+	// are being pinned.
+	signerChange string
+	pinning      bool
+
+	// Keys that are no longer trusted and the keys that may revoke other
+	// keys.
+	revoked  *Revocations
+	revokers []string
+
+	// Options that are set by Git with the `option` command.
+	progress bool
+
+	// Connections that are shared by the URLs on the same host (see
+	// transport).
+	xfers map[string]transport.Transport
+}
 
-	bundleFile, err := os.OpenFile(filepath.Join(cacheDir, filepath.Base(uri.Path)),
-		os.O_RDWR|os.O_CREATE, 0600)
+func Communicate(name string, uris []*url.URL, cacheDir string) (err error) {
+	r, err := openRemote(name, uris, cacheDir)
 	if err != nil {
 		return err
 	}
-	defer errorx.Defer(bundleFile.Close, &err)
+	defer errorx.Defer(r.close, &err)
 
 	scan := bufio.NewScanner(os.Stdin)
 	for scan.Scan() {
 		cmd := scan.Text()
 		log.Tracef("cmd: %s", cmd)
 
-		switch cmd {
-		case "capabilities":
+		switch {
+		case cmd == "capabilities":
 			err := capabilities()
 			if err != nil {
 				return err
 			}
-		case "connect git-upload-pack": // retrievals (e.g., git fetch)
-			err := gitUploadPack(bundleFile, uri, keys)
+		case strings.HasPrefix(cmd, "option "):
+			err := option(r, strings.TrimPrefix(cmd, "option "))
 			if err != nil {
 				return err
 			}
-		case "connect git-receive-pack": // uploads (e.g., git push)
-			err := gitReceivePack(bundleFile, uri, keys)
+		case cmd == "connect git-upload-pack": // retrievals (e.g., git fetch)
+			version, err := RequestedProtocolVersion()
+			if err != nil {
+				return err
+			}
+
+			if version == 2 {
+				err = serveProtocolV2(r)
+			} else {
+				err = gitUploadPack(r)
+			}
+			if err != nil {
+				return err
+			}
+		case cmd == "connect git-receive-pack": // uploads (e.g., git push)
+			err := gitReceivePack(r)
 			if err != nil {
 				return err
 			}
@@ -65,165 +120,925 @@ func Communicate(uri *url.URL, cacheDir string) (err error) {
 	return scan.Err()
 }
 
+// Open the cache of a remote and lock it until the remote is closed.
+func openRemote(name string, uris []*url.URL, cacheDir string) (r *remote, err error) {
+	keys, err := RemoteKeyring(name, uris[0])
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := BundleRefs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := BundlePolicy(name)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := ProtectedRefs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold, err := Threshold(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if threshold > len(keys.Public) {
+		return nil, errors.Errorf("`bundle.%s.threshold` requires %d keys but there are only %d",
+			name, threshold, len(keys.Public))
+	}
+
+	signerChange, err := SignerChange(name)
+	if err != nil {
+		return nil, err
+	}
+
+	revokers, err := Revokers(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := NewCache(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The URLs of a remote share a cache directory because they have
+	// copies of the same repository.
+	dir, err := cache.RemoteDir(uris[0])
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := LockTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := LockFile(filepath.Join(dir, "lock"), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := remoteRevocations(dir, keys)
+	if err != nil {
+		return nil, errorx.Join(err, lock.Unlock())
+	}
+
+	bundleFile, err := os.OpenFile(filepath.Join(dir, "bundle"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errorx.Join(err, lock.Unlock())
+	}
+
+	return &remote{
+		name:         name,
+		uri:          uris[0],
+		uris:         uris,
+		keys:         keys,
+		cache:        cache,
+		dir:          dir,
+		lock:         lock,
+		bundleFile:   bundleFile,
+		refs:         refs,
+		policy:       policy,
+		protected:    protected,
+		threshold:    threshold,
+		signerChange: signerChange,
+		revoked:      revoked,
+		revokers:     revokers,
+		progress:     true,
+		xfers:        map[string]transport.Transport{},
+	}, nil
+}
+
+func (r *remote) close() error {
+	errs := []error{}
+	for _, xfer := range r.xfers {
+		errs = append(errs, xfer.Close())
+	}
+
+	return errorx.Join(append(errs, r.bundleFile.Close(), r.lock.Unlock())...)
+}
+
+// Retrieve a transport for `uri`.
+//
+// Checking a remote involves many small requests, so the transports are
+// shared by every URL with the same scheme, user and host until the remote is
+// closed, instead of opening a new connection for each blob.
+func (r *remote) transport(uri *url.URL) (transport.Transport, error) {
+	key := (&url.URL{Scheme: uri.Scheme, User: uri.User, Host: uri.Host}).String()
+	if xfer, ok := r.xfers[key]; ok {
+		return xfer, nil
+	}
+
+	xfer, err := transport.New(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	r.xfers[key] = xfer
+	return xfer, nil
+}
+
 func capabilities() error {
-	_, err := os.Stdout.WriteString("connect\n\n")
+	_, err := os.Stdout.WriteString("connect\noption\n\n")
 	return err
 }
 
-func gitUploadPack(bundleFile *os.File, uri *url.URL, keys *blob.Keyring) error {
-	return withRemoteBundle(bundleFile, uri, keys, false, func(repo string, _ string) error {
-		uploadPack := exec.Command("git", "upload-pack", repo)
-		uploadPack.Stdin = os.Stdin
-		uploadPack.Stdout = os.Stdout
-		uploadPack.Stderr = os.Stderr
-		return uploadPack.Run()
-	})
-}
+// Set an option from Git and report the result.
+//
+// Options like `dry-run` and `atomic` are never sent to helpers that connect
+// to `git receive-pack`, because send-pack handles them itself.
+func option(r *remote, args string) error {
+	name, value, _ := strings.Cut(args, " ")
+	log.Debugf("option %s: %s", name, value)
 
-func gitReceivePack(bundleFile *os.File, uri *url.URL, keys *blob.Keyring) error {
-	return withRemoteBundle(bundleFile, uri, keys, true, func(repo string, tmp string) (err error) {
-		oldRefs, err := exec.Command("git", "--git-dir", repo, "show-ref").Output()
+	result := "ok"
+	switch name {
+	case "verbosity":
+		verbosity, err := strconv.Atoi(value)
 		if err != nil {
-			oldRefs = []byte{}
+			result = fmt.Sprintf("error invalid verbosity: %s", value)
+			break
 		}
 
-		receivePack := exec.Command("git", "receive-pack", repo)
-		receivePack.Stdin = os.Stdin
-		receivePack.Stdout = os.Stdout
-		receivePack.Stderr = os.Stderr
-		err = receivePack.Run()
+		// The verbosity from Git is 0 for --quiet, 1 by default and
+		// increased by every --verbose.  The configured verbosity is
+		// only overridden if Git asks for more or less output.
+		level := log.GetLevel()
+		switch {
+		case verbosity <= 0 && level > log.WarnLevel:
+			log.SetLevel(log.WarnLevel)
+		case verbosity == 2 && level < log.DebugLevel:
+			log.SetLevel(log.DebugLevel)
+		case verbosity >= 3:
+			log.SetLevel(log.TraceLevel)
+		}
+	case "progress":
+		enabled, err := strconv.ParseBool(value)
 		if err != nil {
-			return err
+			result = fmt.Sprintf("error invalid value for %s: %s", name, value)
+			break
+		}
+		r.progress = enabled
+	default:
+		result = "unsupported"
+	}
+
+	_, err := os.Stdout.WriteString(result + "\n")
+	return err
+}
+
+// Log a message about the progress of a long-running operation unless Git has
+// disabled progress output.
+func (r *remote) progressf(format string, args ...interface{}) {
+	if r.progress {
+		log.Infof(format, args...)
+	} else {
+		log.Debugf(format, args...)
+	}
+}
+
+// Serve `git upload-pack`.
+//
+// If the remote has an up-to-date manifest, the refs are advertised from it
+// and the bundles are only downloaded if the client asks for any objects.
+func gitUploadPack(r *remote) (err error) {
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+
+	best := candidates[0]
+	if best.manifest == nil {
+		return withRemoteBundle(r, candidates, false, func(mirror *Mirror, _ string, chain *Chain) error {
+			err := checkFreeze(chain)
+			if err != nil {
+				return err
+			}
+
+			uploadPack := exec.Command("git", "upload-pack", mirror.Path)
+			uploadPack.Stdin = os.Stdin
+			uploadPack.Stdout = os.Stdout
+			uploadPack.Stderr = os.Stderr
+			return uploadPack.Run()
+		})
+	}
+
+	// The manifest isn't recorded as the state of the remote until the
+	// bundles it describes have been verified.
+	_, err = verifyState(r.statePath(), best.chain)
+	if err != nil {
+		return err
+	}
+
+	err = checkFreeze(best.chain)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.WriteString("\n")
+	if err != nil {
+		return err
+	}
+
+	err = best.manifest.advertise(os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	// The client ends the session with a flush-pkt if it doesn't want any
+	// objects (e.g., for `git ls-remote` or a fetch without changes).
+	pkt, err := readPacket(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	if pkt == nil {
+		log.Debug("no objects requested")
+		return nil
+	}
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	// Only the URLs with the advertised refs can serve the request.
+	sources := []*candidate{}
+	for _, c := range candidates {
+		if c.manifest != nil && c.manifest.Tip == best.manifest.Tip {
+			sources = append(sources, c)
 		}
+	}
+
+	mirror, chain, err := syncCandidates(r, sources, false, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	peeled, err := peeledRefs(mirror.Path, chain.Refs)
+	if err != nil {
+		return err
+	}
+
+	err = best.manifest.verify(chain, peeled)
+	if err != nil {
+		return err
+	}
+
+	request := &bytes.Buffer{}
+	err = writePacket(request, pkt)
+	if err != nil {
+		return err
+	}
+
+	uploadPack := exec.Command("git", "upload-pack", mirror.Path)
+	uploadPack.Stdin = io.MultiReader(request, os.Stdin)
+	uploadPack.Stderr = os.Stderr
+	stdout, err := uploadPack.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = uploadPack.Start()
+	if err != nil {
+		return err
+	}
 
-		newRefs, err := exec.Command("git", "--git-dir", repo, "show-ref").Output()
+	// The client has already received the advertisement from the manifest.
+	for {
+		pkt, err := readPacket(stdout)
 		if err != nil {
-			return err
+			return errorx.Join(err, uploadPack.Process.Kill(), uploadPack.Wait())
 		}
 
-		if bytes.Equal(oldRefs, newRefs) {
-			log.Debug("nothing new to upload")
-			return nil
+		if pkt == nil {
+			break
+		}
+	}
+
+	_, err = io.Copy(os.Stdout, stdout)
+	if err != nil {
+		return errorx.Join(err, uploadPack.Wait())
+	}
+
+	return uploadPack.Wait()
+}
+
+// Download and verify the manifest at `uri`.
+//
+// Nil is returned if there's no manifest or if the manifest doesn't describe
+// the bundles that are currently at `uri`.
+func remoteManifest(r *remote, uri *url.URL) (manifest *Manifest, chain *Chain, err error) {
+	file, err := os.OpenFile(filepath.Join(r.dir, "manifest"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer errorx.Defer(file.Close, &err)
+
+	sealed, err := blob.Download(manifestURL(uri), file, manifestOptions(r.keys))
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			log.Debugf("%s doesn't have a manifest", uri)
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	manifest, err = readManifest(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = r.checkRevoked(manifestURL(uri), sealed, manifest.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = r.checkSigner(manifestURL(uri), sealed.Signer.Fingerprint())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The bundles are verified against the threshold before any objects
+	// are served, but the refs shouldn't be advertised before that either.
+	err = r.checkThreshold(manifestURL(uri), sealed, manifest.Version)
+	if err != nil {
+		if errors.Is(err, ErrThreshold) {
+			log.Debugf("ignoring manifest: %v", err)
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	err = r.authorizeManifest(sealed.Signer.Fingerprint(), manifest)
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			log.Debugf("ignoring manifest: %v", err)
+			return nil, nil, nil
 		}
+		return nil, nil, err
+	}
+
+	chain = &Chain{
+		Repository:   manifest.Repository,
+		Base:         manifest.Base,
+		Tip:          manifest.Tip,
+		Signer:       sealed.Signer.Fingerprint(),
+		Length:       manifest.Length,
+		Version:      manifest.Version,
+		Timestamp:    manifest.Timestamp,
+		Head:         manifest.Head,
+		Refs:         manifest.Refs,
+		ObjectFormat: manifest.ObjectFormat,
+		Next:         manifest.Next,
+	}
+
+	diff, err := diffRemote(r, uri, chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if diff != "" {
+		log.Debugf("ignoring stale manifest: %s", diff)
+		return nil, nil, nil
+	}
+
+	return manifest, chain, nil
+}
+
+// Seal a manifest for `chain` and upload it next to the bundles at `uri`.
+func uploadManifest(r *remote, uri *url.URL, repo string, chain *Chain) (err error) {
+	peeled, err := peeledRefs(repo, chain.Refs)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(r.dir, "manifest"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(file.Close, &err)
+
+	keys, err := r.recipients()
+	if err != nil {
+		return err
+	}
+
+	err = sealManifest(file, &Manifest{
+		Repository:   chain.Repository,
+		Base:         chain.Base,
+		Tip:          chain.Tip,
+		Length:       chain.Length,
+		Next:         chain.Next,
+		Version:      chain.Version,
+		Timestamp:    chain.Timestamp,
+		Head:         chain.Head,
+		Refs:         chain.Refs,
+		Peeled:       peeled,
+		ObjectFormat: chain.ObjectFormat,
+	}, keys)
+	if err != nil {
+		return err
+	}
+
+	return blob.Upload(manifestURL(uri), file, manifestOptions(r.keys))
+}
+
+// Serve `git receive-pack`.
+//
+// The push is received by `git receive-pack` in a temporary repository with
+// the refs of the remote, and the result is sealed and uploaded before the
+// report-status is relayed to Git (see report).
+func gitReceivePack(r *remote) error {
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
 
-		tmpPath := filepath.Join(tmp, "plaintext")
-		err = exec.Command("git", "--git-dir", repo, "bundle", "create",
-			tmpPath, "--branches", "--tags").Run()
+	return withRemoteBundle(r, candidates, true, func(mirror *Mirror, tmp string, chain *Chain) (err error) {
+		repo, err := mirror.workspace(tmp)
 		if err != nil {
 			return err
 		}
 
-		tmpFile, err := os.Open(tmpPath) // #nosec G304
+		err = r.installUpdateHook(repo)
 		if err != nil {
 			return err
 		}
-		defer errorx.Defer(tmpFile.Close, &err)
 
-		err = bundleFile.Truncate(0)
+		err = r.installPreUpload(repo)
 		if err != nil {
 			return err
 		}
 
-		writer, err := blob.NewWriter(bundleFile, &blob.Options{
-			Type:      metadata.Name(),
-			Keyring:   keys,
-			Encrypted: Encrypt(),
-		})
+		receivePack := exec.Command("git", "-c", "receive.autogc=false", "receive-pack", repo)
+		receivePack.Stdin = os.Stdin
+		receivePack.Stderr = os.Stderr
+		stdout, err := receivePack.StdoutPipe()
 		if err != nil {
 			return err
 		}
-		defer errorx.Defer(writer.Close, &err)
 
-		err = iofs.Copy(writer, tmpFile)
+		err = receivePack.Start()
 		if err != nil {
 			return err
 		}
 
-		err = writer.Sign()
+		err = relayAdvertisement(stdout, os.Stdout)
 		if err != nil {
-			return err
+			return errorx.Join(err, receivePack.Process.Kill(), receivePack.Wait())
 		}
 
-		err = bundleFile.Sync()
+		rep, err := readReport(stdout)
 		if err != nil {
-			return err
+			return errorx.Join(err, receivePack.Process.Kill(), receivePack.Wait())
 		}
 
-		err = blob.Upload(uri, bundleFile, &blob.Options{
-			Type:      metadata.Name(),
-			Keyring:   keys,
-			Encrypted: Encrypt(),
-		})
+		err = receivePack.Wait()
 		if err != nil {
 			return err
 		}
 
-		return nil
+		if rep == nil {
+			log.Debug("nothing was pushed")
+			return nil
+		}
+
+		if rep.accepted() {
+			err = uploadPush(r, candidates, mirror, tmp, chain, repo)
+			if err != nil {
+				log.Errorf("%s", err)
+				rep.reject(err)
+			}
+		}
+
+		return rep.write(os.Stdout)
 	})
 }
 
-func withRemoteBundle(bundleFile *os.File, uri *url.URL, keys *blob.Keyring, allowMissing bool,
-	fn func(string, string) error) (err error) {
+// Seal and upload the refs in `repo` after they've been received by `git
+// receive-pack`.
+func uploadPush(r *remote, candidates []*candidate, mirror *Mirror, tmp string, chain *Chain,
+	repo string) error {
+	allRefs, err := showRefs(repo)
+	if err != nil {
+		return err
+	}
+
+	// Pushes of excluded refs are rejected by the update hook, so this
+	// only drops refs from remotes that were pushed with other patterns.
+	refs := filterRefs(allRefs, r.refs)
+	for _, ref := range sortedRefs(allRefs) {
+		if _, ok := refs[ref]; !ok {
+			log.Warnf("%s is excluded from the bundle by `bundle.%s.refs`", ref, r.name)
+		}
+	}
+
+	oldRefs := map[string]string{}
+	if chain != nil {
+		oldRefs = chain.Refs
+	}
+
+	head, err := defaultHead(chain, refs, repo)
+	if err != nil {
+		return err
+	}
+
+	if equalRefs(oldRefs, refs) && (chain == nil || chain.Head == head) {
+		log.Debug("nothing new to upload")
+		return nil
+	}
+
+	pushed, err := pushBundle(r, candidates, mirror, tmp, chain, repo, refs, head, pushAuto)
+	if err != nil {
+		return err
+	}
+
+	return r.postUpload(pushed)
+}
+
+func withRemoteBundle(r *remote, candidates []*candidate, allowMissing bool,
+	fn func(*Mirror, string, *Chain) error) (err error) {
 	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
 	if err != nil {
 		return err
 	}
 	defer errorx.Defer(tmpCleanup, &err)
 
-	tmpRepo := filepath.Join(tmpDir, "repo")
-	bundle, err := blob.Download(uri, bundleFile, &blob.Options{
+	mirror, chain, err := syncCandidates(r, candidates, allowMissing, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.WriteString("\n")
+	if err != nil {
+		return err
+	}
+
+	return fn(mirror, tmpDir, chain)
+}
+
+// Bring the mirror up to date with the verified bundles at `r.uri`.
+//
+// A nil chain is returned if the remote doesn't exist and `allowMissing` is
+// true.
+func syncRemote(r *remote, allowMissing bool, tmpDir string) (*Mirror, *Chain, error) {
+	mirror, err := openMirror(r.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := &blob.Options{
 		Type:      metadata.Name(),
-		Keyring:   keys,
+		Keyring:   r.keys,
 		Encrypted: Encrypt(),
-	})
+	}
+
+	chain, err := cachedChain(r, mirror)
 	if err != nil {
-		if !allowMissing || !errors.Is(err, transport.ErrNotExist) {
-			return err
+		return nil, nil, err
+	}
+
+	if chain == nil {
+		bundle, err := blob.Download(r.uri, r.bundleFile, opts)
+		if err != nil {
+			if !allowMissing || !errors.Is(err, transport.ErrNotExist) {
+				return nil, nil, err
+			}
+
+			// A new remote gets the object format of the local
+			// repository.
+			format, err := objectFormat("")
+			if err != nil {
+				return nil, nil, err
+			}
+
+			err = mirror.reset(format)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			chain, err = syncMirror(r, opts, mirror, bundle, filepath.Join(tmpDir, "bundle"))
+			if err != nil {
+				return nil, nil, err
+			}
 		}
+	}
 
-		log.Tracef("initializing bare repo in %s", tmpRepo)
-		err := exec.Command("git", "init", "--bare", tmpRepo).Run()
+	err = checkState(r.statePath(), chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if chain != nil {
+		err = setHead(mirror.Path, chain.Head, chain.Refs)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-	} else {
-		log.Infof("%s: signed by %s", bundleFile.Name(), bundle.Signer)
-		log.Infof("%s: sha2-256: %s", bundleFile.Name(), bundle.Metadata.Hashes.SHA256)
-		log.Infof("%s: sha3-512: %s", bundleFile.Name(), bundle.Metadata.Hashes.KECCAK512)
-		log.Infof("%s: blake2b-512: %s", bundleFile.Name(), bundle.Metadata.Hashes.BLAKE2b512)
 
-		tmpBundle := filepath.Join(tmpDir, "bundle")
-		f, err := os.Create(tmpBundle)
+		err = writeChain(r.chainPath(), chain)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		defer errorx.Defer(f.Close, &err)
 
-		_, err = iofs.Seek(bundle, 0, io.SeekStart)
+		err = r.cache.Record(r.uris[0], chain.Tip, chain.Signer)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+	}
+
+	return mirror, chain, nil
+}
+
+// Retrieve the last verified chain for the remote if neither the remote nor
+// the mirror have changed since it was verified.
+//
+// The remote is compared by reading the metadata of the bundles in the chain,
+// so an unchanged remote doesn't have to be downloaded and verified again.
+func cachedChain(r *remote, mirror *Mirror) (*Chain, error) {
+	chain, err := readChain(r.chainPath())
+	if err != nil || chain == nil {
+		return nil, err
+	}
+
+	if mirror.Base != chain.Base || mirror.Tip != chain.Tip || mirror.Length != chain.Length {
+		log.Debugf("the mirror for %s doesn't match the cached chain", r.uri)
+		return nil, nil
+	}
+
+	diff, err := diffRemote(r, r.uri, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	if diff != "" {
+		log.Debugf("%s", diff)
+		return nil, nil
+	}
+
+	log.Infof("%s is unchanged", r.uri)
+	return chain, nil
+}
+
+// Replay the chain that starts with the full bundle in `bundle` and apply the
+// bundles that are missing in `mirror`.
+func syncMirror(r *remote, opts *blob.Options, mirror *Mirror, bundle *blob.Reader,
+	tmpBundle string) (*Chain, error) {
+	logBlob(r.bundleFile.Name(), bundle)
+
+	hdr, err := blobHeader(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkRevoked(r.uri, bundle, hdr.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkSigner(r.uri, bundle.Signer.Fingerprint())
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Index != 0 {
+		return nil, errors.Errorf("%s: expected a full bundle, got index %d", r.bundleFile.Name(),
+			hdr.Index)
+	}
+
+	chain := &Chain{
+		Repository:   hdr.Repository,
+		Base:         bundle.Metadata.Hashes.SHA256,
+		Tip:          bundle.Metadata.Hashes.SHA256,
+		Signer:       bundle.Signer.Fingerprint(),
+		Version:      hdr.Version,
+		Timestamp:    hdr.Timestamp,
+		Head:         hdr.Head,
+		Refs:         hdr.Refs,
+		ObjectFormat: hdr.ObjectFormat,
+	}
+	if chain.ObjectFormat == "" {
+		chain.ObjectFormat = "sha1"
+	}
+
+	// The mirror is invalidated before the rest of the chain is verified,
+	// so a full bundle from another repository or an older chain must be
+	// rejected before it replaces the mirror.
+	err = checkBase(r.statePath(), chain)
+	if err != nil {
+		return nil, err
+	}
+
+	if mirror.Base != chain.Base {
+		r.progressf("cloning %s", r.bundleFile.Name())
+
+		err := r.checkThreshold(r.uri, bundle, hdr.Version)
+		if err != nil {
+			return nil, err
 		}
 
-		_, err = io.Copy(f, bundle)
+		err = mirror.invalidate()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		err = f.Sync()
+		_, err = extractBundle(bundle, tmpBundle)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		err = cloneBundle(tmpBundle, tmpRepo)
+		err = cloneBundle(tmpBundle, mirror.Path)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		format, err := objectFormat(mirror.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if format != chain.ObjectFormat {
+			return nil, errors.Errorf("%s: object format %s doesn't match %s", r.bundleFile.Name(),
+				format, chain.ObjectFormat)
+		}
+
+		err = mirror.save(chain.Base, chain.Tip, 0)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	_, err = os.Stdout.WriteString("\n")
+	// Bundles created by older versions don't include the refs in their
+	// header.
+	if chain.Refs == nil && mirror.Length == 0 {
+		refs, err := showRefs(mirror.Path)
+		if err != nil {
+			return nil, err
+		}
+		chain.Refs = filterRefs(refs, r.refs)
+	}
+
+	err = r.authorizeBase(chain, hdr.Parent, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	for {
+		ok, err := applyIncremental(r, opts, chain, mirror, tmpBundle)
+		if err == nil && chain.Length < mirror.Length && !ok {
+			// The remote has fewer incremental bundles than the
+			// mirror, which must not be a rollback.
+			_, err = verifyState(r.statePath(), chain)
+			if err == nil {
+				err = errMirrorStale
+			}
+		}
+
+		if errors.Is(err, errMirrorStale) {
+			log.Infof("rebuilding the mirror for %s", r.uri)
+
+			err := mirror.invalidate()
+			if err != nil {
+				return nil, err
+			}
+			return syncMirror(r, opts, mirror, bundle, tmpBundle)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return chain, nil
+		}
+	}
+}
+
+// Download the next incremental bundle in `chain` and apply it to `mirror`
+// unless it has already been applied.
+//
+// False is returned if there's no incremental bundle to apply.
+func applyIncremental(r *remote, opts *blob.Options, chain *Chain, mirror *Mirror,
+	tmpBundle string) (ok bool, err error) {
+	index := chain.Length + 1
+
+	incFile, err := incrementalFile(r.bundleFile, index)
+	if err != nil {
+		return false, err
+	}
+	defer errorx.Defer(incFile.Close, &err)
+
+	inc, err := blob.Download(incrementalURL(r.uri, index), incFile, opts)
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return false, os.Remove(incFile.Name())
+		}
+		return false, err
+	}
+
+	hdr, err := blobHeader(inc)
+	if err != nil {
+		return false, err
+	}
+
+	hash := inc.Metadata.Hashes.SHA256
+	if hdr.Index != index || hdr.Base != chain.Base || hdr.Parent != chain.Tip {
+		log.Debugf("%s: ignoring incremental bundle from another chain", incFile.Name())
+		chain.Next = hash
+		return false, nil
+	}
+
+	logBlob(incFile.Name(), inc)
+
+	err = r.checkRevoked(incrementalURL(r.uri, index), inc, hdr.Version)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.checkSigner(incrementalURL(r.uri, index), inc.Signer.Fingerprint())
+	if err != nil {
+		return false, err
+	}
+
+	if hdr.Repository != chain.Repository {
+		return false, errors.Errorf("%s: repository '%s' doesn't match '%s'", incFile.Name(),
+			hdr.Repository, chain.Repository)
+	}
+
+	format := hdr.ObjectFormat
+	if format == "" {
+		format = "sha1"
+	}
+
+	if format != chain.ObjectFormat {
+		return false, errors.Errorf("%s: object format %s doesn't match %s", incFile.Name(), format,
+			chain.ObjectFormat)
+	}
+
+	if hdr.Version <= chain.Version {
+		return false, errors.Errorf("%s: version %d doesn't follow %d", incFile.Name(), hdr.Version,
+			chain.Version)
+	}
+
+	// The parent of the incremental bundle is `chain.Tip`, so `chain.Refs`
+	// are the refs that it changes.
+	err = r.policy.authorize(inc.Signer.Fingerprint(), chain.Refs, hdr.Refs)
+	if err != nil {
+		return false, errors.Wrap(err, incFile.Name())
+	}
+
+	if index == mirror.Length && hash != mirror.Tip {
+		return false, errMirrorStale
+	}
+
+	if index > mirror.Length {
+		err := r.checkThreshold(incrementalURL(r.uri, index), inc, hdr.Version)
+		if err != nil {
+			return false, err
+		}
+
+		err = mirror.invalidate()
+		if err != nil {
+			return false, err
+		}
+
+		_, err = extractBundle(inc, tmpBundle)
+		if err != nil {
+			return false, err
+		}
+
+		err = applyBundle(tmpBundle, mirror.Path, hdr.Refs)
+		if err != nil {
+			return false, err
+		}
+
+		err = mirror.save(chain.Base, hash, index)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	return fn(tmpRepo, tmpDir)
+	chain.Length = index
+	chain.Tip = hash
+	chain.Signer = inc.Signer.Fingerprint()
+	chain.Version = hdr.Version
+	chain.Timestamp = hdr.Timestamp
+	chain.Head = hdr.Head
+	chain.Refs = hdr.Refs
+	return true, nil
+}
+
+func (r *remote) statePath() string {
+	return filepath.Join(r.dir, "state.json")
+}
+
+func (r *remote) chainPath() string {
+	return filepath.Join(r.dir, "chain.json")
 }
@@ -0,0 +1,513 @@
+package git_test
+
+import (
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/illikainen/git-remote-bundle/src/git"
+)
+
+func TestPushAndClone(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+
+	out := e.git("a", "push", "origin", "main")
+	if !strings.Contains(out, "* [new branch]      main -> main") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	if !e.uploaded(out, "repo") || e.exists("repo.inc.1") {
+		t.Fatal("expected a full bundle")
+	}
+
+	e.git("", "clone", "--quiet", e.url("repo"), "b")
+	if e.revParse("b", "HEAD") != e.revParse("a", "HEAD") {
+		t.Fatal("the clone doesn't match the pushed repository")
+	}
+
+	// The next push is an incremental bundle on top of the full bundle.
+	second := e.commit("a", "second")
+	out = e.git("a", "push", "origin", "main")
+	if e.uploaded(out, "repo") || !e.uploaded(out, "repo.inc.1") {
+		t.Fatalf("expected an incremental bundle:\n%s", out)
+	}
+
+	e.git("b", "fetch", "--quiet", "origin")
+	if e.revParse("b", "origin/main") != second {
+		t.Fatal("the fetch didn't replay the incremental bundle")
+	}
+
+	e.git("", "clone", "--quiet", e.url("repo"), "c")
+	if e.revParse("c", "HEAD") != second {
+		t.Fatal("the clone didn't replay the incremental bundle")
+	}
+
+	// Branches and tags are pushed and deleted like in any other remote.
+	e.git("a", "tag", "--annotate", "--message", "v1", "v1")
+	e.git("a", "push", "origin", "main:refs/heads/other", "v1")
+	e.git("a", "push", "origin", "--delete", "other")
+
+	out = e.git("a", "ls-remote", "origin")
+	if strings.Contains(out, "refs/heads/other") || !strings.Contains(out, "refs/tags/v1^{}") {
+		t.Fatalf("unexpected refs:\n%s", out)
+	}
+
+	// The chain is consolidated into a new full bundle once it's long
+	// enough.
+	third := e.commit("a", "third")
+	out = e.git("a", "-c", "bundle.consolidate=0", "push", "origin", "main")
+	if !e.uploaded(out, "repo") || e.uploaded(out, "repo.inc.4") {
+		t.Fatalf("expected a full bundle:\n%s", out)
+	}
+
+	e.git("b", "fetch", "--quiet", "--tags", "origin")
+	if e.revParse("b", "origin/main") != third || e.revParse("b", "v1^{}") != second {
+		t.Fatal("the fetch didn't replay the consolidated bundle")
+	}
+
+	e.git("", "clone", "--quiet", e.url("repo"), "d")
+	if e.revParse("d", "HEAD") != third {
+		t.Fatal("the clone doesn't match the consolidated bundle")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+
+	cmd := exec.Command(e.path("bin/git-remote-bundle"), "origin", strings.TrimPrefix(e.url("repo"), "bundle::"))
+	cmd.Dir = e.path("a")
+	cmd.Env = append(e.env, "GIT_DIR="+e.path("a/.git"),
+		"GIT_EXEC_PATH="+strings.TrimSpace(e.git("", "--exec-path")))
+	cmd.Stdin = strings.NewReader("capabilities\noption verbosity 1\noption progress false\n" +
+		"option progress maybe\noption verbosity x\noption depth 1\n")
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+
+	expected := "connect\noption\n\nok\nok\nerror invalid value for progress: maybe\n" +
+		"error invalid verbosity: x\nunsupported\n"
+	if string(stdout) != expected {
+		t.Fatalf("expected %q, got %q", expected, stdout)
+	}
+
+	// Progress messages are only logged if Git asks for progress.
+	out := e.git("a", "push", "--no-progress", "origin", "main")
+	if strings.Contains(out, "creating full bundle") || !e.uploaded(out, "repo") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.commit("a", "second")
+	out = e.git("a", "push", "--progress", "origin", "main")
+	if !strings.Contains(out, "creating incremental bundle 1") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// The configured verbosity is lowered by --quiet and raised by
+	// --verbose.
+	e.commit("a", "third")
+	out = e.git("a", "push", "--quiet", "origin", "main")
+	if strings.Contains(out, "level=info") || e.uploaded(out, "repo.inc.2") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	out = e.git("a", "fetch", "--verbose", "--verbose", "origin")
+	if !strings.Contains(out, "level=debug") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
+
+func TestPushSandboxPaths(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", e.path("home/.gitconfig"))
+	t.Setenv("GIT_CONFIG_PARAMETERS", "")
+	e.git("", "config", "--global", "bundle.consolidate", "1")
+	e.initRepo("a", "repo")
+
+	uri := &url.URL{Scheme: "file", Path: e.path("remotes/repo")}
+	for i, msg := range []string{"first", "second", "third"} {
+		// The paths are those that the sandbox would get before the
+		// push, and every blob that is written must be below them.
+		_, rw, err := git.RemoteSandboxPaths("origin", []*url.URL{uri})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i > 0 {
+			e.commit("a", msg)
+		}
+		e.git("a", "push", "origin", "main")
+
+		err = filepath.WalkDir(e.path("remotes"), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+
+			for _, dir := range rw {
+				if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+					return nil
+				}
+			}
+
+			t.Errorf("%s push: %s isn't writable in the sandbox", msg, path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPushFetchFirst(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+	e.git("a", "push", "origin", "main")
+	e.git("", "clone", "--quiet", e.url("repo"), "b")
+
+	e.commit("a", "a")
+	e.git("a", "push", "origin", "main")
+
+	// The advertised refs come from the remote as it is when the push
+	// starts, so Git rejects the push on its own.
+	before := e.revParse("b", "origin/main")
+	e.commit("b", "b")
+	out := e.gitFail("b", "push", "origin", "main")
+	if !strings.Contains(out, "[rejected]") || !strings.Contains(out, "fetch first") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	if e.revParse("b", "origin/main") != before {
+		t.Fatal("the tracking ref was updated")
+	}
+}
+
+func TestFetchProtocolVersions(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+	e.git("a", "push", "origin", "main")
+	e.git("", "clone", "--quiet", e.url("repo"), "b")
+
+	for _, version := range []string{"0", "1", "2"} {
+		tip := e.commit("a", version)
+		e.git("a", "push", "origin", "main")
+
+		cmd := e.command("b", "-c", "protocol.version="+version, "fetch", "origin")
+		cmd.Env = append(cmd.Env, "GIT_TRACE_PACKET=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("protocol version %s: %v\n%s", version, err, out)
+		}
+
+		v2 := strings.Contains(string(out), "fetch< version 2")
+		if v2 != (version == "2") {
+			t.Fatalf("protocol version %s: unexpected protocol\n%s", version, out)
+		}
+
+		if e.revParse("b", "origin/main") != tip {
+			t.Fatalf("protocol version %s: the fetch didn't update origin/main", version)
+		}
+	}
+
+	// The refs are advertised from the manifest and nothing is downloaded
+	// if the client doesn't want any objects.
+	for _, version := range []string{"0", "2"} {
+		out := e.git("b", "-c", "protocol.version="+version, "ls-remote", "origin")
+		if !strings.Contains(out, e.revParse("a", "HEAD")+"\trefs/heads/main") {
+			t.Fatalf("protocol version %s: unexpected refs\n%s", version, out)
+		}
+	}
+}
+
+func TestPushConcurrentUpdate(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+	e.git("a", "push", "origin", "main")
+	out, err := exec.Command("cp", "-R", e.path("remotes"), e.path("v1")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v", out, err)
+	}
+
+	// Another client with its own cache pushes a new version, which is
+	// set aside and replaced with the previous version.
+	e.git("", "-c", "bundle.cacheDir="+e.path("cache-b"), "clone", "--quiet", e.url("repo"), "b")
+	e.git("b", "config", "bundle.cacheDir", e.path("cache-b"))
+	e.commit("b", "b")
+	e.git("b", "push", "origin", "main")
+	for _, mv := range [][]string{{"remotes", "v2"}, {"v1", "remotes"}} {
+		err := os.Rename(e.path(mv[0]), e.path(mv[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The new version shows up while the push is being received.
+	hook := "#!/bin/sh\ncp -R '" + e.path("v2") + "/.' '" + e.path("remotes") + "'\n"
+	err = os.WriteFile(e.path("hook"), []byte(hook), 0700) // #nosec G306
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.git("a", "config", "bundle.preUploadHook", e.path("hook"))
+
+	before := e.revParse("a", "origin/main")
+	e.commit("a", "a")
+	rejected := e.gitFail("a", "push", "origin", "main")
+	if !strings.Contains(rejected, "! [remote rejected] main -> main (fetch first)") {
+		t.Fatalf("unexpected output:\n%s", rejected)
+	}
+
+	if e.revParse("a", "origin/main") != before {
+		t.Fatal("the tracking ref was updated by a rejected push")
+	}
+
+	e.git("a", "config", "--unset", "bundle.preUploadHook")
+	e.git("a", "fetch", "--quiet", "origin")
+	if e.revParse("a", "origin/main") != e.revParse("b", "HEAD") {
+		t.Fatal("the concurrent push was overwritten")
+	}
+}
+
+func TestFetchRollback(t *testing.T) {
+	e := newTestEnv(t)
+	e.git("", "config", "--global", "bundle.consolidate", "0")
+	e.initRepo("a", "repo")
+	e.git("a", "push", "origin", "main")
+	out, err := exec.Command("cp", "-R", e.path("remotes"), e.path("v1")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v", out, err)
+	}
+
+	// Without a manifest, the refs are advertised from the mirror.
+	err = os.Remove(e.path("v1/repo.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.commit("a", "second")
+	e.git("a", "push", "origin", "main")
+	for _, mv := range [][]string{{"remotes", "v2"}, {"v1", "remotes"}} {
+		err := os.Rename(e.path(mv[0]), e.path(mv[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rejected := e.gitFail("a", "fetch", "origin")
+	if !strings.Contains(rejected, "the full bundle with version 1 doesn't follow 2") {
+		t.Fatalf("unexpected output:\n%s", rejected)
+	}
+
+	// The mirror still matches the last verified version.
+	err = os.Remove(e.path("v2/repo.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mv := range [][]string{{"remotes", "v1"}, {"v2", "remotes"}} {
+		err := os.Rename(e.path(mv[0]), e.path(mv[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetched := e.git("a", "fetch", "origin")
+	if !strings.Contains(fetched, "is unchanged") {
+		t.Fatalf("unexpected output:\n%s", fetched)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	e := newTestEnv(t)
+	e.git("", "config", "--global", "bundle.encrypt", "true")
+	e.initRepo("a", "repo")
+	e.git("a", "push", "origin", "main")
+	e.commit("a", "second")
+	e.git("a", "push", "origin", "main")
+
+	out := e.helper("a", "rekey", "origin")
+	for _, name := range []string{"repo.inc.1", "repo.log.1", "repo.log.2"} {
+		if !strings.Contains(out, filepath.Join(e.dir, "remotes", name)+" is sealed for the previous keyring") {
+			t.Fatalf("%s isn't listed:\n%s", name, out)
+		}
+	}
+
+	if e.exists("repo.gen.1") {
+		t.Fatal("the re-sealed chain was kept as a generation")
+	}
+
+	e.git("", "clone", "--quiet", e.url("repo"), "b")
+	if e.revParse("b", "HEAD") != e.revParse("a", "HEAD") {
+		t.Fatal("unexpected HEAD")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	e := newTestEnv(t)
+	bob := e.genkey("bob")
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "bundle.origin.signerChange", "warn")
+	e.git("", "config", "--global", "bundle.consolidate", "0")
+
+	// The first generation is signed by a key that doesn't sign the
+	// current chain.
+	e.initRepo("a", "repo")
+	first := e.revParse("a", "HEAD")
+	e.git("a", "-c", "bundle.privKey="+e.path("bob.priv"), "push", "origin", "main")
+	e.commit("a", "second")
+	e.git("a", "push", "origin", "main")
+
+	// The restore runs with an empty cache, so the signer of the current
+	// chain is pinned.
+	e.git("", "init", "--quiet", "b")
+	e.git("b", "remote", "add", "origin", e.url("repo"))
+	e.git("b", "config", "bundle.cacheDir", e.path("cache-b"))
+	out := e.helper("b", "restore", "origin")
+	if strings.Contains(out, "pinning "+bob) || !strings.Contains(out, bob+" (approve it with") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.git("a", "fetch", "--quiet", "origin")
+	if e.revParse("a", "origin/main") != first {
+		t.Fatal("the generation wasn't restored")
+	}
+}
+
+func TestCosignThreshold(t *testing.T) {
+	e := newTestEnv(t)
+	e.genkey("bob")
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "bundle.origin.threshold", "2")
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	e.git("a", "push", "origin", "main")
+
+	// The push is only signed by one of the two required keys.
+	out := e.gitFail("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-v"), e.url("repo"),
+		"v")
+	if !strings.Contains(out, "signed by 1 of the 2 required keys") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.git("", "init", "--quiet", "b")
+	e.git("b", "remote", "add", "origin", e.url("repo"))
+	e.git("b", "config", "bundle.cacheDir", e.path("cache-b"))
+	e.git("b", "config", "bundle.privKey", e.path("bob.priv"))
+	out = e.helper("b", "cosign", "origin")
+	if !strings.Contains(out, "co-signed 2 blobs") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-w"), e.url("repo"), "w")
+	if e.revParse("w", "HEAD") != e.revParse("a", "HEAD") {
+		t.Fatal("unexpected HEAD")
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	e := newTestEnv(t)
+
+	// The force-push is uploaded as an incremental bundle with the default
+	// `bundle.consolidate`, so there's no generation to restore.
+	e.initRepo("a", "repo")
+	first := e.revParse("a", "HEAD")
+	e.git("a", "push", "origin", "main")
+	e.git("a", "commit", "--quiet", "--amend", "--message", "amended")
+	amended := e.revParse("a", "HEAD")
+	e.git("a", "push", "--force", "origin", "main")
+
+	out := e.helperFail("a", "restore", "origin")
+	if !strings.Contains(out, "the generation doesn't exist") || strings.Contains(out, "Usage:") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.helper("a", "restore", "--at", "1", "origin")
+	e.git("a", "fetch", "--quiet", "origin")
+	if e.revParse("a", "origin/main") != first {
+		t.Fatal("the version wasn't restored")
+	}
+
+	// The restore replaced the chain, which can be restored in turn.
+	e.helper("a", "restore", "origin")
+	e.git("a", "fetch", "--quiet", "origin")
+	if e.revParse("a", "origin/main") != amended {
+		t.Fatal("the restore wasn't undone")
+	}
+}
+
+func TestPushAndCloneSHA256(t *testing.T) {
+	e := newTestEnv(t)
+
+	err := os.MkdirAll(e.path("remotes"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.git("", "init", "--quiet", "--object-format=sha256", "a")
+	e.git("a", "remote", "add", "origin", e.url("repo"))
+	e.commit("a", "initial")
+	e.git("a", "push", "origin", "main")
+
+	second := e.commit("a", "second")
+	out := e.git("a", "push", "origin", "main")
+	if !e.uploaded(out, "repo.inc.1") {
+		t.Fatalf("expected an incremental bundle:\n%s", out)
+	}
+
+	if len(second) != 64 {
+		t.Fatalf("unexpected object ID: %s", second)
+	}
+
+	for _, version := range []string{"0", "2"} {
+		dir := "b" + version
+		e.git("", "-c", "protocol.version="+version, "clone", "--quiet", e.url("repo"), dir)
+		if e.revParse(dir, "HEAD") != second {
+			t.Fatalf("protocol v%s: the clone doesn't match the pushed repository", version)
+		}
+
+		format := strings.TrimSpace(e.git(dir, "rev-parse", "--show-object-format"))
+		if format != "sha256" {
+			t.Fatalf("protocol v%s: unexpected object format %s", version, format)
+		}
+	}
+}
+
+func TestRemoteKeyrings(t *testing.T) {
+	e := newTestEnv(t)
+	e.genkey("bob")
+	e.git("", "config", "--global", "bundle.encrypt", "true")
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+
+	// Bob is only a recipient of the bundles in the shared remote.
+	shared := "bundle.file://" + e.path("remotes/shared") + ".pubKeys"
+	e.git("", "config", "--global", "--add", shared, e.path("key.pub"))
+	e.git("", "config", "--global", "--add", shared, e.path("bob.pub"))
+
+	e.initRepo("a", "private")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	e.git("a", "remote", "add", "shared", e.url("shared"))
+	e.git("a", "push", "origin", "main")
+	e.git("a", "push", "shared", "main")
+
+	bob := []string{"-c", "bundle.privKey=" + e.path("bob.priv"), "-c", "bundle.cacheDir=" + e.path("cache-b"),
+		"clone", "--quiet"}
+	e.git("", append(bob, e.url("shared"), "b")...)
+	if e.revParse("b", "HEAD") != e.revParse("a", "HEAD") {
+		t.Fatal("unexpected HEAD")
+	}
+
+	out := e.gitFail("", append(bob, e.url("private"), "c")...)
+	if !strings.Contains(out, "missing symmetric keys") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
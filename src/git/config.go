@@ -3,17 +3,22 @@ package git
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/illikainen/git-remote-bundle/src/metadata"
 
 	"github.com/illikainen/go-cryptor/src/blob"
 	"github.com/illikainen/go-utils/src/iofs"
 	"github.com/illikainen/go-utils/src/stringx"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -31,6 +36,50 @@ func ReadKeyring() (*blob.Keyring, error) {
 	return blob.ReadKeyring(privkey, pubkeys)
 }
 
+// Read the keyring for a remote.
+//
+// The keys are read from `remote.<name>.bundlePrivKey` and
+// `remote.<name>.bundlePubKeys`, from `bundle.<url>.privKey` and
+// `bundle.<url>.pubKeys` where `<url>` matches the URL of the remote, or from
+// `bundle.privKey` and `bundle.pubKeys`, in that order.  The first of these
+// that is set is used on its own, so a remote can be limited to a smaller set
+// of recipients and signers than the global keyring.
+func RemoteKeyring(name string, uri *url.URL) (*blob.Keyring, error) {
+	privkeys, err := RemoteKeyPaths(name, uri, "privKey")
+	if err != nil {
+		return nil, err
+	}
+
+	privkey := ""
+	if len(privkeys) > 0 {
+		privkey = privkeys[len(privkeys)-1]
+	}
+
+	pubkeys, err := RemoteKeyPaths(name, uri, "pubKeys")
+	if err != nil {
+		return nil, err
+	}
+
+	return blob.ReadKeyring(privkey, pubkeys)
+}
+
+// The paths in the first of `remote.<name>.bundle<Key>`, `bundle.<url>.<key>`
+// and `bundle.<key>` that is set for a remote.  See RemoteKeyring.
+func RemoteKeyPaths(name string, uri *url.URL, key string) ([]string, error) {
+	paths, err := ConfigSlice(fmt.Sprintf("remote.%s.bundle%s", name,
+		strings.ToUpper(key[:1])+key[1:]), "path")
+	if err != nil || len(paths) > 0 {
+		return paths, err
+	}
+
+	paths, err = ConfigURLMatch("bundle", key, uri, "path")
+	if err != nil || len(paths) > 0 {
+		return paths, err
+	}
+
+	return ConfigSlice("bundle."+key, "path")
+}
+
 func CacheDir() (string, error) {
 	baseDirs, err := ConfigSlice("bundle.cacheDir", "path")
 	if err == nil && len(baseDirs) == 1 {
@@ -54,6 +103,51 @@ func Verbosity() (string, error) {
 	return verbosity, nil
 }
 
+// The protocol version that the client asks for on `connect git-upload-pack`.
+//
+// Git doesn't pass `GIT_PROTOCOL` to helpers that use `connect` and accepts
+// whichever version the service starts with, so the version is read from
+// `GIT_PROTOCOL` if it's set and from `protocol.version` otherwise.  The latter
+// includes any `-c protocol.version=<n>` given to the Git command that runs
+// the helper.
+func RequestedProtocolVersion() (int, error) {
+	params, ok := os.LookupEnv("GIT_PROTOCOL")
+	if !ok {
+		return ProtocolVersion()
+	}
+
+	version := 0
+	for _, param := range strings.Split(params, ":") {
+		if strings.HasPrefix(param, "version=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(param, "version="))
+			if err != nil {
+				return 0, errors.Wrap(err, "GIT_PROTOCOL")
+			}
+
+			if n > version {
+				version = n
+			}
+		}
+	}
+
+	return version, nil
+}
+
+// The protocol version in `protocol.version` that Git uses to fetch.  The
+// default is 2, like in Git.
+func ProtocolVersion() (int, error) {
+	version, err := Config("protocol.version", "int")
+	if err != nil {
+		return 0, err
+	}
+
+	if version != "" {
+		return strconv.Atoi(version)
+	}
+
+	return 2, nil
+}
+
 func Encrypt() bool {
 	encrypt, err := Config("bundle.encrypt", "bool")
 	if err != nil {
@@ -64,6 +158,290 @@ func Encrypt() bool {
 	return encrypt == "true"
 }
 
+// The number of incremental bundles to push on top of a full bundle before the
+// next push consolidates the repository into a new full bundle.
+func Consolidate() (int, error) {
+	consolidate, err := Config("bundle.consolidate", "int")
+	if err != nil {
+		return 0, err
+	}
+
+	if consolidate != "" {
+		return strconv.Atoi(consolidate)
+	}
+
+	return 16, nil
+}
+
+// The number of previous chains to keep on the remote when a push replaces the
+// full bundle.
+func Generations() (int, error) {
+	generations, err := Config("bundle.generations", "int")
+	if err != nil {
+		return 0, err
+	}
+
+	if generations != "" {
+		return strconv.Atoi(generations)
+	}
+
+	return 2, nil
+}
+
+// The time to wait for another process to release a lock in the cache
+// directory before giving up.
+func LockTimeout() (time.Duration, error) {
+	timeout, err := Config("bundle.lockTimeout", "int")
+	if err != nil {
+		return 0, err
+	}
+
+	if timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 60 * time.Second, nil
+}
+
+// Whether to accept a remote that is older than the last seen version.  This
+// should only be enabled temporarily (e.g., with `git -c`) after the reason for
+// the rollback has been investigated.
+func AllowRollback() (bool, error) {
+	allow, err := Config("bundle.allowRollback", "bool")
+	if err != nil {
+		return false, err
+	}
+
+	return allow == "true", nil
+}
+
+// The number of days in `bundle.maxAge` after which a remote that hasn't been
+// pushed to is refused on a fetch.  The default is 0, which disables the check.
+func MaxAge() (time.Duration, error) {
+	days, err := Config("bundle.maxAge", "int")
+	if err != nil {
+		return 0, err
+	}
+
+	if days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return 0, nil
+}
+
+// The URL of the remote named `remote` in `remote.<name>.url`.  If there's no
+// such remote, `remote` is interpreted as a URL.
+func RemoteURL(remote string) (*url.URL, error) {
+	uri, err := Config(fmt.Sprintf("remote.%s.url", remote), "path")
+	if err != nil {
+		return nil, err
+	}
+
+	if uri == "" {
+		uri = remote
+	}
+
+	return url.Parse(strings.TrimPrefix(uri, "bundle::"))
+}
+
+// The URLs of a remote.  The URL that the remote was configured with comes
+// first and is followed by the URLs in `bundle.<remote>.mirror`, which may be
+// specified with or without the `bundle::` prefix.
+//
+// Every URL is expected to have a copy of the same repository.  Fetches use the
+// URL with the newest version and pushes are uploaded to all of them.
+func RemoteURLs(name string, uri *url.URL) ([]*url.URL, error) {
+	mirrors, err := ConfigSlice(fmt.Sprintf("bundle.%s.mirror", name), "path")
+	if err != nil {
+		return nil, err
+	}
+
+	uris := []*url.URL{uri}
+	for _, mirror := range mirrors {
+		mirrorURI, err := url.Parse(strings.TrimPrefix(mirror, "bundle::"))
+		if err != nil {
+			return nil, err
+		}
+
+		if NormalizeURL(mirrorURI) == NormalizeURL(uri) {
+			continue
+		}
+		uris = append(uris, mirrorURI)
+	}
+
+	return uris, nil
+}
+
+// The patterns in `bundle.<remote>.refs` for the refs that are included in the
+// bundles pushed to a remote.  Each pattern is either the full name of a ref or
+// a name with a single `*`, as in a refspec.  The default is to push branches
+// and tags.
+func BundleRefs(name string) ([]string, error) {
+	patterns, err := ConfigSlice(fmt.Sprintf("bundle.%s.refs", name), "path")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(patterns) == 0 {
+		return []string{"refs/heads/*", "refs/tags/*"}, nil
+	}
+
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "refs/") || strings.Count(pattern, "*") > 1 {
+			return nil, errors.Errorf("invalid pattern in `bundle.%s.refs`: %s", name, pattern)
+		}
+	}
+
+	return patterns, nil
+}
+
+// The policy in `bundle.<remote>.authorize` for the refs that each signer is
+// allowed to change.  Every value is a fingerprint followed by one or more
+// patterns in the same format as `bundle.<remote>.refs`, separated by
+// whitespace.  A signer may be listed in several values.
+//
+// If the option isn't set, any signer in the keyring may change any ref.
+// Otherwise, bundles that change refs that aren't allowed for their signer are
+// rejected when they're fetched, and pushes of refs that aren't allowed for
+// our own key are rejected per ref.
+//
+// The policy is read from the local configuration and isn't signed.  Like
+// `bundle.pubKeys`, it's a trust decision that each client makes for itself:
+// anyone who can change the local configuration can replace the keyring as
+// well, so a signed policy wouldn't protect against them.  A policy that is
+// distributed through the remote would in turn need a signer that is trusted
+// for every ref, which is what the policy is meant to avoid.
+func BundlePolicy(name string) (Policy, error) {
+	key := fmt.Sprintf("bundle.%s.authorize", name)
+	values, err := ConfigSlice(key, "path")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	policy := Policy{}
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("invalid value in `%s`: %s", key, value)
+		}
+
+		for _, pattern := range fields[1:] {
+			if !strings.HasPrefix(pattern, "refs/") || strings.Count(pattern, "*") > 1 {
+				return nil, errors.Errorf("invalid pattern in `%s`: %s", key, pattern)
+			}
+		}
+
+		policy[fields[0]] = append(policy[fields[0]], fields[1:]...)
+	}
+
+	return policy, nil
+}
+
+// The patterns in `bundle.<remote>.protect` for the refs that may not be
+// deleted or updated to a commit that doesn't descend from the current one.
+// The patterns are in the same format as `bundle.<remote>.refs`.
+func ProtectedRefs(name string) ([]string, error) {
+	key := fmt.Sprintf("bundle.%s.protect", name)
+	patterns, err := ConfigSlice(key, "path")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "refs/") || strings.Count(pattern, "*") > 1 {
+			return nil, errors.Errorf("invalid pattern in `%s`: %s", key, pattern)
+		}
+	}
+
+	return patterns, nil
+}
+
+// The number of keys in `bundle.<remote>.threshold` that must sign each bundle
+// before it's accepted on a fetch.  The key that seals a bundle is one of the
+// signers; the others add their signature with the `cosign` command.  The
+// default is 1.
+func Threshold(name string) (int, error) {
+	threshold, err := Config(fmt.Sprintf("bundle.%s.threshold", name), "int")
+	if err != nil {
+		return 0, err
+	}
+
+	if threshold != "" {
+		return strconv.Atoi(threshold)
+	}
+
+	return 1, nil
+}
+
+// How to handle a bundle that is signed by a key that hasn't published to the
+// remote before according to `bundle.<remote>.signerChange`.  Either `reject`
+// (the default) or `warn`.
+func SignerChange(name string) (string, error) {
+	key := fmt.Sprintf("bundle.%s.signerChange", name)
+	change, err := Config(key, "path")
+	if err != nil {
+		return "", err
+	}
+
+	switch change {
+	case "":
+		return "reject", nil
+	case "reject", "warn":
+		return change, nil
+	default:
+		return "", errors.Errorf("invalid value in `%s`: %s", key, change)
+	}
+}
+
+// The path to the `preUpload` or `postUpload` hook of a remote in
+// `bundle.<remote>.<hook>Hook`, or in `bundle.<hook>Hook` for every remote.
+// An empty string is returned if there's no hook.
+func UploadHook(name string, hook string) (string, error) {
+	keys := []string{fmt.Sprintf("bundle.%s.%sHook", name, hook), fmt.Sprintf("bundle.%sHook", hook)}
+	for _, key := range keys {
+		path, err := Config(key, "path")
+		if err != nil {
+			return "", err
+		}
+
+		if path != "" {
+			return expand(path)
+		}
+	}
+
+	return "", nil
+}
+
+// The fingerprints in `bundle.<remote>.revokers` of the keys that may revoke
+// other keys in the revocation lists of a remote.  Any other key may only
+// revoke itself.
+func Revokers(name string) ([]string, error) {
+	return ConfigSlice(fmt.Sprintf("bundle.%s.revokers", name), "path")
+}
+
+// The path in `bundle.revocations` to the local list of revoked keys.
+func RevocationsPath() (string, error) {
+	path, err := Config("bundle.revocations", "path")
+	if err != nil || path == "" {
+		return "", err
+	}
+
+	return expand(path)
+}
+
 // The `merge.verifySignatures` option has nothing to do with the cryptographic
 // operations performed by this remote helper.  It's a built-in option in Git
 // to enable signature verification during merge operations.
@@ -102,6 +480,70 @@ func Config(name string, vtype string) (string, error) {
 	return s, nil
 }
 
+// Retrieve the values of `<section>.<url>.<key>` for the `<url>` that best
+// matches `uri`.
+//
+// Like the `http.<url>.*` options in Git, `<url>` matches if it has the same
+// scheme, host and (if specified) user as `uri` and if its path is a prefix of
+// the path of `uri` that ends at a `/` or at the end of the path.  The longest
+// matching path is used.  Unlike `git config --get-urlmatch`, every value of a
+// multi-valued option is returned.
+func ConfigURLMatch(section string, key string, uri *url.URL, vtype string) ([]string, error) {
+	// Git canonicalizes the names of sections and keys to lowercase.
+	pattern := fmt.Sprintf("^%s\\..*\\.%s$", regexp.QuoteMeta(strings.ToLower(section)),
+		regexp.QuoteMeta(strings.ToLower(key)))
+	output, err := exec.Command("git", "config", "--type", vtype, "--get-regexp", pattern).Output()
+	if err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if ok && exit.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	best := ""
+	values := []string{}
+	scan := bufio.NewScanner(bytes.NewReader(output))
+	for scan.Scan() {
+		name, value, _ := strings.Cut(scan.Text(), " ")
+		subsection := name[len(section)+1 : len(name)-len(key)-1]
+
+		candidate, err := url.Parse(strings.TrimPrefix(subsection, "bundle::"))
+		if err != nil || candidate.Scheme == "" || !matchURL(candidate, uri) {
+			continue
+		}
+
+		if len(candidate.Path) > len(best) || len(values) == 0 {
+			best = candidate.Path
+			values = nil
+		}
+
+		if candidate.Path == best {
+			values = append(values, value)
+		}
+	}
+
+	err = scan.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func matchURL(pattern *url.URL, uri *url.URL) bool {
+	if !strings.EqualFold(pattern.Scheme, uri.Scheme) || !strings.EqualFold(pattern.Host, uri.Host) {
+		return false
+	}
+
+	if pattern.User != nil && (uri.User == nil || pattern.User.Username() != uri.User.Username()) {
+		return false
+	}
+
+	prefix := strings.TrimSuffix(pattern.Path, "/")
+	return uri.Path == prefix || strings.HasPrefix(uri.Path, prefix+"/")
+}
+
 func ConfigSlice(name string, vtype string) ([]string, error) {
 	output, err := exec.Command("git", "config", "--type", vtype, "--get-all", name).Output()
 	if err != nil {
@@ -182,6 +624,12 @@ func SandboxPaths() (ro []string, rw []string, err error) {
 		}
 	}
 
+	revocations, err := RevocationsPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	ro = append(ro, revocations)
+
 	cache, err := CacheDir()
 	if err != nil {
 		return nil, nil, err
@@ -191,6 +639,104 @@ func SandboxPaths() (ro []string, rw []string, err error) {
 	return ro, rw, nil
 }
 
+// The paths to the keys and the hooks of a remote that must be readable in the
+// sandbox, and the paths to the blobs of `file://` URLs that must be writable.
+//
+// The directories of the URLs are writable because pushes create new blobs
+// next to the full bundle (e.g., incremental bundles and push records).  If
+// `bundle.<remote>.sandboxDir` is false, only the blobs of the remote that
+// already exist are writable, which is enough for fetches but not for pushes.
+func RemoteSandboxPaths(name string, uris []*url.URL) (ro []string, rw []string, err error) {
+	for _, hook := range []string{"preUpload", "postUpload"} {
+		path, err := UploadHook(name, hook)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if path != "" {
+			ro = append(ro, path)
+		}
+	}
+
+	for _, key := range []string{"pubKeys", "privKey"} {
+		paths, err := RemoteKeyPaths(name, uris[0], key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, path := range paths {
+			realPath, err := expand(path)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			ro = append(ro, realPath)
+		}
+	}
+
+	dirs, err := Config(fmt.Sprintf("bundle.%s.sandboxDir", name), "bool")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, uri := range uris {
+		if uri.Scheme != "file" {
+			continue
+		}
+
+		if dirs != "false" {
+			rw = append(rw, filepath.Dir(uri.Path))
+			continue
+		}
+
+		blobs, err := localBlobs(uri.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		rw = append(rw, blobs...)
+	}
+
+	return ro, rw, nil
+}
+
+// Suffixes of the blobs that are stored next to the full bundle of a remote.
+var blobSuffixes = []string{".inc.", ".manifest", ".log.", ".sig.", ".gen.", ".revocations"}
+
+// Retrieve the paths to the full bundle in `path` and the blobs next to it
+// that exist.
+func localBlobs(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	base := filepath.Base(path)
+	blobs := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == base {
+			blobs = append(blobs, path)
+			continue
+		}
+
+		if entry.IsDir() {
+			continue
+		}
+
+		for _, suffix := range blobSuffixes {
+			if strings.HasPrefix(name, base+suffix) {
+				blobs = append(blobs, filepath.Join(filepath.Dir(path), name))
+				break
+			}
+		}
+	}
+
+	return blobs, nil
+}
+
 func expand(path string) (string, error) {
 	intPath, err := stringx.Interpolate(path)
 	if err != nil {
@@ -0,0 +1,178 @@
+package git
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRequestedProtocolVersion(t *testing.T) {
+	tests := []struct {
+		env     string
+		version int
+	}{
+		{"version=2", 2},
+		{"version=1", 1},
+		{"", 0},
+		{"foo=bar", 0},
+		{"foo=bar:version=2", 2},
+		{"version=1:version=2", 2},
+	}
+
+	for _, test := range tests {
+		t.Setenv("GIT_PROTOCOL", test.env)
+
+		version, err := RequestedProtocolVersion()
+		if err != nil {
+			t.Fatalf("%q: %v", test.env, err)
+		}
+
+		if version != test.version {
+			t.Errorf("%q: expected %d, got %d", test.env, test.version, version)
+		}
+	}
+
+	t.Setenv("GIT_PROTOCOL", "version=x")
+	_, err := RequestedProtocolVersion()
+	if err == nil {
+		t.Error("expected an error for an invalid version")
+	}
+}
+
+func TestRemoteSandboxPaths(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+	t.Setenv("GIT_CONFIG_PARAMETERS", "")
+
+	dir := t.TempDir()
+	for _, name := range []string{"repo", "repo.inc.1", "repo.manifest", "repo.log.1", "repo.sig.00",
+		"repo.gen.1", "repo.gen.1.inc.1", "repo.revocations", "repo.txt", "repository", "other"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uris := []*url.URL{
+		{Scheme: "file", Path: filepath.Join(dir, "repo")},
+		{Scheme: "file", Path: filepath.Join(dir, "missing", "repo")},
+		{Scheme: "sftp", Host: "example.com", Path: "/repo"},
+	}
+
+	_, rw, err := RemoteSandboxPaths("origin", uris)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{dir, filepath.Join(dir, "missing")}
+	if !reflect.DeepEqual(rw, expected) {
+		t.Errorf("expected %v, got %v", expected, rw)
+	}
+
+	t.Setenv("GIT_CONFIG_PARAMETERS", "'bundle.origin.sandboxDir'='false'")
+	_, rw, err = RemoteSandboxPaths("origin", uris)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{}
+	for _, name := range []string{"repo", "repo.gen.1", "repo.gen.1.inc.1", "repo.inc.1", "repo.log.1",
+		"repo.manifest", "repo.revocations", "repo.sig.00"} {
+		expected = append(expected, filepath.Join(dir, name))
+	}
+
+	sort.Strings(rw)
+	if !reflect.DeepEqual(rw, expected) {
+		t.Errorf("expected %v, got %v", expected, rw)
+	}
+}
+
+func TestConfigURLMatch(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "gitconfig")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", config)
+	t.Setenv("GIT_CONFIG_PARAMETERS", "")
+
+	for _, option := range [][2]string{
+		{"bundle.sftp://example.com/repos.pubKeys", "/a"},
+		{"bundle.sftp://example.com/repos.pubKeys", "/b"},
+		{"bundle.sftp://example.com/repos/x.pubKeys", "/c"},
+		{"bundle.bundle::sftp://user@example.com/other/.pubKeys", "/d"},
+		{"bundle.file:///repos.pubKeys", "/e"},
+		{"bundle.sftp://example.com/repos.privKey", "/f"},
+	} {
+		out, err := exec.Command("git", "config", "--file", config, "--add", option[0], option[1]).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+
+	tests := []struct {
+		uri      string
+		expected []string
+	}{
+		{"sftp://example.com/repos/y", []string{"/a", "/b"}},
+		{"sftp://example.com/repos", []string{"/a", "/b"}},
+		{"SFTP://EXAMPLE.COM/repos/y", []string{"/a", "/b"}},
+		{"sftp://example.com/repos/x", []string{"/c"}},
+		{"sftp://example.com/repos/x/y", []string{"/c"}},
+		{"sftp://example.com/repos/xy", []string{"/a", "/b"}},
+		{"sftp://example.com/reposx", nil},
+		{"sftp://user@example.com/other/z", []string{"/d"}},
+		{"sftp://example.com/other/z", nil},
+		{"sftp://example.org/repos/y", nil},
+		{"https://example.com/repos/y", nil},
+		{"file:///repos/z", []string{"/e"}},
+	}
+
+	for _, test := range tests {
+		uri, err := url.Parse(test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := ConfigURLMatch("bundle", "pubKeys", uri, "path")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(values) != len(test.expected) || (len(values) > 0 && !reflect.DeepEqual(values, test.expected)) {
+			t.Errorf("%s: expected %v, got %v", test.uri, test.expected, values)
+		}
+	}
+}
+
+func TestRemoteKeyPaths(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+
+	uri := &url.URL{Scheme: "sftp", Host: "example.com", Path: "/repos/x"}
+	tests := []struct {
+		config   string
+		expected []string
+	}{
+		{"'bundle.pubkeys'='/global'", []string{"/global"}},
+		{"'bundle.pubkeys'='/global' 'bundle.sftp://example.com/repos.pubkeys'='/url'", []string{"/url"}},
+		{"'bundle.pubkeys'='/global' 'bundle.sftp://example.com/other.pubkeys'='/url'", []string{"/global"}},
+		{"'bundle.sftp://example.com/repos.pubkeys'='/url' 'remote.origin.bundlepubkeys'='/remote' " +
+			"'remote.origin.bundlepubkeys'='/remote2'", []string{"/remote", "/remote2"}},
+		{"'remote.other.bundlepubkeys'='/remote'", nil},
+	}
+
+	for _, test := range tests {
+		t.Setenv("GIT_CONFIG_PARAMETERS", test.config)
+
+		paths, err := RemoteKeyPaths("origin", uri, "pubKeys")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(paths) != len(test.expected) || (len(paths) > 0 && !reflect.DeepEqual(paths, test.expected)) {
+			t.Errorf("%s: expected %v, got %v", test.config, test.expected, paths)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-netutils/src/transport"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signature is a detached co-signature for a sealed blob.
+//
+// A sealed blob can only be signed by the key that sealed it, so additional
+// signatures are uploaded as separate sealed blobs to `<blob>.sig.<id>`, where
+// `id` is derived from the fingerprint of the co-signer.  The co-signature
+// commits to the blob with its hashes, which are in turn covered by the
+// signature of the blob.
+type Signature struct {
+	Format int
+
+	// Hashes of the co-signed blob.
+	SHA256     string
+	KECCAK512  string
+	BLAKE2b512 string
+}
+
+const SignatureFormat = 1
+
+const signatureMagic = "# git-remote-bundle signature v1\n"
+
+var ErrInvalidSignature = errors.New("invalid co-signature")
+
+var ErrThreshold = errors.New("not enough signatures")
+
+func signatureURL(uri *url.URL, fingerprint string) *url.URL {
+	sum := sha256.Sum256([]byte(fingerprint))
+	sig := *uri
+	sig.Path = fmt.Sprintf("%s.sig.%x", uri.Path, sum[:8])
+	sig.RawPath = ""
+	return &sig
+}
+
+func signatureOptions(keys *blob.Keyring) *blob.Options {
+	return &blob.Options{
+		Type:      metadata.Name() + "-signature",
+		Keyring:   keys,
+		Encrypted: Encrypt(),
+	}
+}
+
+// Verify that the sealed blob in `sealed`, downloaded from `uri`, is signed
+// by at least `bundle.<remote>.threshold` of the keys in the keyring.
+//
+// The key that sealed the blob counts as one of the signers.  The blob
+// describes `version` of the remote.
+func (r *remote) checkThreshold(uri *url.URL, sealed *blob.Reader, version uint64) (err error) {
+	if r.threshold <= 1 {
+		return nil
+	}
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	signer := sealed.Signer.Fingerprint()
+	signers := map[string]bool{signer: true}
+
+	for _, key := range r.keys.Public {
+		fingerprint := key.Fingerprint()
+		if signers[fingerprint] {
+			continue
+		}
+
+		ok, err := verifySignature(r, signatureURL(uri, fingerprint), sealed, version, fingerprint,
+			filepath.Join(tmpDir, "signature"))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			log.Infof("%s: co-signed by %s", uri, key)
+			signers[fingerprint] = true
+		}
+	}
+
+	if len(signers) < r.threshold {
+		return errors.Wrapf(ErrThreshold, "%s: signed by %d of the %d required keys", uri, len(signers),
+			r.threshold)
+	}
+
+	return nil
+}
+
+// Verify the co-signature by `fingerprint` at `uri` for the blob in `sealed`.
+//
+// False is returned if there's no co-signature or if it doesn't cover the
+// blob.
+func verifySignature(r *remote, uri *url.URL, sealed *blob.Reader, version uint64, fingerprint string,
+	path string) (ok bool, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600) // #nosec G304
+	if err != nil {
+		return false, err
+	}
+	defer errorx.Defer(file.Close, &err)
+
+	cosigned, err := blob.Download(uri, file, signatureOptions(r.keys))
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return false, nil
+		}
+
+		log.Warnf("ignoring %s: %v", uri, err)
+		return false, nil
+	}
+
+	if cosigned.Signer.Fingerprint() != fingerprint {
+		log.Warnf("ignoring %s: signed by %s", uri, cosigned.Signer)
+		return false, nil
+	}
+
+	err = r.checkRevoked(uri, cosigned, version)
+	if err != nil {
+		log.Warnf("ignoring %v", err)
+		return false, nil
+	}
+
+	sig, err := readSignature(cosigned)
+	if err != nil {
+		log.Warnf("ignoring %s: %v", uri, err)
+		return false, nil
+	}
+
+	hashes := sealed.Metadata.Hashes
+	if sig.SHA256 != hashes.SHA256 || sig.KECCAK512 != hashes.KECCAK512 ||
+		sig.BLAKE2b512 != hashes.BLAKE2b512 {
+		log.Debugf("ignoring %s: it co-signs another blob", uri)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Seal a co-signature for the blob in `target` and write the result to
+// `sealed`.
+func sealSignature(sealed *os.File, target *blob.Reader, keys *blob.Keyring) (err error) {
+	_, err = iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = sealed.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	writer, err := blob.NewWriter(sealed, signatureOptions(keys))
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(writer.Close, &err)
+
+	data, err := json.Marshal(&Signature{
+		Format:     SignatureFormat,
+		SHA256:     target.Metadata.Hashes.SHA256,
+		KECCAK512:  target.Metadata.Hashes.KECCAK512,
+		BLAKE2b512: target.Metadata.Hashes.BLAKE2b512,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append([]byte(signatureMagic), data...))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Sign()
+	if err != nil {
+		return err
+	}
+
+	return sealed.Sync()
+}
+
+// Read the co-signature from the payload of a verified blob.
+func readSignature(sealed *blob.Reader) (*Signature, error) {
+	_, err := iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(signatureMagic)) {
+		return nil, errors.Wrap(ErrInvalidSignature, "missing magic")
+	}
+
+	sig := &Signature{}
+	err = json.Unmarshal(data[len(signatureMagic):], sig)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidSignature, err.Error())
+	}
+
+	if sig.Format != SignatureFormat {
+		return nil, errors.Wrapf(ErrInvalidSignature, "unsupported format %d", sig.Format)
+	}
+
+	return sig, nil
+}
+
+// A sealed blob in the chain of a remote together with a function that
+// resolves its location at any URL of the remote.
+type chainBlob struct {
+	file    *os.File
+	sealed  *blob.Reader
+	version uint64
+	url     func(*url.URL) *url.URL
+}
+
+// Add our signature to the bundles in the chain of a remote and to its
+// manifest.
+//
+// The bundles are verified like on a fetch, except that they don't need to
+// have enough signatures yet (see verifyUnsigned).  The co-signatures are
+// uploaded to every URL of the remote that has the same bundles.
+func Cosign(name string, uris []*url.URL, cacheDir string) (err error) {
+	r, err := openRemote(name, uris, cacheDir)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(r.close, &err)
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+	r.uri = candidates[0].uri
+
+	mirror, chain, err := verifyUnsigned(r, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	peeled, err := peeledRefs(mirror.Path, chain.Refs)
+	if err != nil {
+		return err
+	}
+
+	blobs, err := chainBlobs(r, tmpDir, chain, peeled)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, b := range blobs {
+			errorx.Defer(b.file.Close, &err)
+		}
+	}()
+
+	keys, err := r.recipients()
+	if err != nil {
+		return err
+	}
+
+	fingerprint := r.keys.Private.Fingerprint()
+	signed := 0
+
+	for _, b := range blobs {
+		uri := b.url(r.uri)
+		if b.sealed.Signer.Fingerprint() == fingerprint {
+			log.Infof("%s is signed by us", uri)
+			continue
+		}
+
+		ok, err := verifySignature(r, signatureURL(uri, fingerprint), b.sealed, b.version, fingerprint,
+			filepath.Join(tmpDir, "signature"))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			log.Infof("%s is already co-signed by us", uri)
+			continue
+		}
+
+		file, err := os.Create(filepath.Join(tmpDir, "cosign")) // #nosec G304
+		if err != nil {
+			return err
+		}
+
+		err = sealSignature(file, b.sealed, keys)
+		if err == nil {
+			err = uploadSignature(r, b, file, fingerprint)
+		}
+
+		err = errorx.Join(err, file.Close())
+		if err != nil {
+			return err
+		}
+		signed++
+	}
+
+	log.Infof("co-signed %d blobs", signed)
+	return nil
+}
+
+// Upload the co-signature in `file` for `b` to every URL of the remote that
+// has the blob.
+func uploadSignature(r *remote, b *chainBlob, file *os.File, fingerprint string) error {
+	uploaded := 0
+	for _, uri := range r.uris {
+		hash, err := r.remoteHash(b.url(uri))
+		if err != nil {
+			return err
+		}
+
+		if hash != b.sealed.Metadata.Hashes.SHA256 {
+			log.Warnf("skipping %s: it doesn't have the co-signed blob", uri)
+			continue
+		}
+
+		err = blob.Upload(signatureURL(b.url(uri), fingerprint), file, signatureOptions(r.keys))
+		if err != nil {
+			return err
+		}
+		uploaded++
+	}
+
+	if uploaded == 0 {
+		return errors.Errorf("unable to upload the co-signature for %s", b.url(r.uri))
+	}
+
+	return nil
+}
+
+// Verify the chain at `r.uri` like on a fetch, except that the bundles don't
+// need enough signatures yet, and replay it into a temporary mirror in
+// `tmpDir`.
+//
+// The chain is verified by a remote of its own in `tmpDir` with copies of the
+// state, the last verified chain and the signers of the remote, so the
+// rollback protection, the policy and the signers apply as usual but a chain
+// without enough signatures is never recorded as verified.
+func verifyUnsigned(r *remote, tmpDir string) (mirror *Mirror, chain *Chain, err error) {
+	dir := filepath.Join(tmpDir, "unsigned")
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cache, err := NewCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unsigned := &remote{
+		name:         r.name,
+		uri:          r.uri,
+		uris:         r.uris,
+		keys:         r.keys,
+		cache:        cache,
+		dir:          dir,
+		refs:         r.refs,
+		policy:       r.policy,
+		protected:    r.protected,
+		threshold:    1,
+		signerChange: r.signerChange,
+		revoked:      r.revoked,
+		revokers:     r.revokers,
+		progress:     r.progress,
+		xfers:        r.xfers,
+	}
+
+	for _, path := range [][2]string{
+		{r.statePath(), unsigned.statePath()},
+		{r.chainPath(), unsigned.chainPath()},
+		{r.signersPath(), unsigned.signersPath()},
+	} {
+		data, err := os.ReadFile(path[0])
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, nil, err
+		}
+
+		err = os.WriteFile(path[1], data, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	unsigned.bundleFile, err = os.Create(filepath.Join(dir, "bundle")) // #nosec G304
+	if err != nil {
+		return nil, nil, err
+	}
+	defer errorx.Defer(unsigned.bundleFile.Close, &err)
+
+	return syncRemote(unsigned, false, tmpDir)
+}
+
+// Download the bundles in the verified `chain` at `r.uri` and the manifest
+// that describes them with the annotated tags in `peeled`.
+//
+// The bundles are downloaded to `tmpDir` rather than to the cache because
+// they may not have enough signatures to be trusted yet.  The remote must not
+// have changed since `chain` was verified.
+func chainBlobs(r *remote, tmpDir string, chain *Chain, peeled map[string]string) (blobs []*chainBlob,
+	err error) {
+	defer func() {
+		if err != nil {
+			for _, b := range blobs {
+				errorx.Defer(b.file.Close, &err)
+			}
+		}
+	}()
+
+	opts := &blob.Options{
+		Type:      metadata.Name(),
+		Keyring:   r.keys,
+		Encrypted: Encrypt(),
+	}
+
+	base := ""
+	tip := ""
+
+	for index := 0; ; index++ {
+		index := index
+		locate := func(uri *url.URL) *url.URL {
+			if index == 0 {
+				return uri
+			}
+			return incrementalURL(uri, index)
+		}
+
+		file, sealed, err := downloadBlob(locate(r.uri), filepath.Join(tmpDir, fmt.Sprintf("bundle.%d", index)),
+			opts)
+		if err != nil {
+			if index > 0 && errors.Is(err, transport.ErrNotExist) {
+				break
+			}
+			return blobs, err
+		}
+		hdr, err := blobHeader(sealed)
+		if err != nil {
+			return blobs, errorx.Join(err, file.Close())
+		}
+		blobs = append(blobs, &chainBlob{file: file, sealed: sealed, version: hdr.Version, url: locate})
+
+		hash := sealed.Metadata.Hashes.SHA256
+		if index == 0 {
+			if hdr.Index != 0 {
+				return blobs, errors.Errorf("%s: expected a full bundle, got index %d", r.uri, hdr.Index)
+			}
+			base = hash
+		} else if hdr.Index != index || hdr.Base != base || hdr.Parent != tip {
+			blobs = blobs[:len(blobs)-1]
+			err = file.Close()
+			if err != nil {
+				return blobs, err
+			}
+			break
+		}
+
+		log.Infof("%s: version %d signed by %s", locate(r.uri), hdr.Version, sealed.Signer)
+		tip = hash
+	}
+
+	if base != chain.Base || tip != chain.Tip || len(blobs) != chain.Length+1 {
+		return blobs, errors.Wrapf(ErrRemoteChanged, "'%s' != '%s'", tip, chain.Tip)
+	}
+
+	return blobs, manifestBlob(r, tmpDir, chain, peeled, &blobs)
+}
+
+// Append the manifest at `r.uri` to `blobs` if it describes the verified
+// `chain` with the annotated tags in `peeled`.
+func manifestBlob(r *remote, tmpDir string, chain *Chain, peeled map[string]string,
+	blobs *[]*chainBlob) error {
+	file, sealed, err := downloadBlob(manifestURL(r.uri), filepath.Join(tmpDir, "manifest"),
+		manifestOptions(r.keys))
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	manifest, err := readManifest(sealed)
+	if err != nil {
+		return errorx.Join(err, file.Close())
+	}
+
+	err = manifest.verify(chain, peeled)
+	if err != nil {
+		log.Warnf("skipping the manifest for %s: %v", r.uri, err)
+		return file.Close()
+	}
+
+	*blobs = append(*blobs, &chainBlob{file: file, sealed: sealed, version: manifest.Version, url: manifestURL})
+	return nil
+}
+
+// Download the sealed blob at `uri` to `path`.  The file is left open for the
+// returned reader.
+func downloadBlob(uri *url.URL, path string, opts *blob.Options) (*os.File, *blob.Reader, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600) // #nosec G304
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := blob.Download(uri, file, opts)
+	if err != nil {
+		return nil, nil, errorx.Join(err, file.Close())
+	}
+
+	return file, sealed, nil
+}
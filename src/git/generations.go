@@ -0,0 +1,345 @@
+package git
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-netutils/src/transport"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Previous chains of a remote are kept as generations next to the bundles.
+//
+// A push that replaces the full bundle first copies the current chain to
+// `<url>.gen.1` (with its incremental bundles in `<url>.gen.1.inc.<n>`) after
+// moving the older generations one step up, up to `bundle.generations`.  The
+// transports can't rename or remove files, so the generations are rotated by
+// copying them.
+//
+// Pushes that are uploaded as incremental bundles (including force-pushes)
+// don't start a new generation.  The versions in the current chain are
+// restored from the chain itself instead.
+
+var ErrNoGeneration = errors.New("the generation doesn't exist")
+
+func generationURL(uri *url.URL, generation int) *url.URL {
+	gen := *uri
+	gen.Path = fmt.Sprintf("%s.gen.%d", uri.Path, generation)
+	gen.RawPath = ""
+	return &gen
+}
+
+// Move the generations at `uri` one step up and copy the current chain to
+// the first generation.
+func rotateGenerations(r *remote, uri *url.URL) (err error) {
+	generations, err := Generations()
+	if err != nil || generations <= 0 {
+		return err
+	}
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	for gen := generations; gen > 0; gen-- {
+		src := uri
+		if gen > 1 {
+			src = generationURL(uri, gen-1)
+		}
+
+		err := copyChain(r, src, generationURL(uri, gen), tmpDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy the full bundle at `src` and the incremental bundles next to it to
+// `dst`.
+//
+// The blobs are copied as-is without being verified, so the rotation works
+// even if the chain was sealed for other recipients.  They're verified if the
+// generation is restored.
+func copyChain(r *remote, src *url.URL, dst *url.URL, tmpDir string) error {
+	ok, err := copyBlob(r, src, dst, tmpDir)
+	if err != nil || !ok {
+		return err
+	}
+
+	for index := 1; ; index++ {
+		ok, err := copyBlob(r, incrementalURL(src, index), incrementalURL(dst, index), tmpDir)
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// Copy the blob at `src` to `dst`.  False is returned if `src` doesn't exist.
+func copyBlob(r *remote, src *url.URL, dst *url.URL, tmpDir string) (ok bool, err error) {
+	path := filepath.Join(tmpDir, "copy")
+
+	srcXfer, err := r.transport(src)
+	if err != nil {
+		return false, err
+	}
+
+	err = srcXfer.Download(src.Path, path)
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	dstXfer, err := r.transport(dst)
+	if err != nil {
+		return false, err
+	}
+
+	log.Infof("copying %s to %s", src, dst)
+	return true, dstXfer.Upload(dst.Path, path)
+}
+
+// Verify the chain in generation `generation` of the remote and replay it
+// into a temporary mirror in `tmpDir`.
+//
+// The generation is verified like the current chain on a fetch, except that
+// the policy and the threshold aren't enforced because it was accepted when it
+// was current.  The restored refs are authorized and signed by us when they're
+// pushed.
+//
+// The chain is verified by a remote of its own in `tmpDir`, so the state, the
+// last verified chain and the signers of the remote aren't modified.  Its
+// signers are checked against a copy of the signers of the remote without
+// pinning, so a generation can't approve a signer.
+func syncGeneration(r *remote, generation int, tmpDir string) (mirror *Mirror, chain *Chain, err error) {
+	dir := filepath.Join(tmpDir, "generation")
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gen := &remote{
+		name:         r.name,
+		uri:          generationURL(r.uri, generation),
+		uris:         r.uris,
+		keys:         r.keys,
+		dir:          dir,
+		refs:         r.refs,
+		threshold:    1,
+		signerChange: r.signerChange,
+		revoked:      r.revoked,
+		revokers:     r.revokers,
+		progress:     r.progress,
+		xfers:        r.xfers,
+	}
+
+	signers, err := readSigners(r.signersPath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if signers == nil {
+		signers = &Signers{Approved: map[string]int64{}, Pending: map[string]int64{}}
+	}
+
+	err = writeSigners(gen.signersPath(), signers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gen.bundleFile, err = os.Create(filepath.Join(dir, "bundle")) // #nosec G304
+	if err != nil {
+		return nil, nil, err
+	}
+	defer errorx.Defer(gen.bundleFile.Close, &err)
+
+	mirror, err = openMirror(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := &blob.Options{
+		Type:      metadata.Name(),
+		Keyring:   r.keys,
+		Encrypted: Encrypt(),
+	}
+
+	bundle, err := blob.Download(gen.uri, gen.bundleFile, opts)
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return nil, nil, errors.Wrapf(ErrNoGeneration, "%s (versions in the current chain are "+
+				"restored by their version)", gen.uri)
+		}
+		return nil, nil, err
+	}
+
+	chain, err = syncMirror(gen, opts, mirror, bundle, filepath.Join(dir, "plaintext"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mirror, chain, nil
+}
+
+// Retrieve the refs at `version` in the verified `chain` of a remote from the
+// cached bundles of the chain.
+//
+// The cached bundles are verified to link up with the tip of the chain.
+func chainVersion(r *remote, chain *Chain, version uint64) (restored *Chain, err error) {
+	opts := &blob.Options{
+		Type:      metadata.Name(),
+		Keyring:   r.keys,
+		Encrypted: Encrypt(),
+	}
+
+	expected := chain.Tip
+	for index := chain.Length; index >= 0; index-- {
+		file := r.bundleFile
+		if index > 0 {
+			f, err := incrementalFile(r.bundleFile, index)
+			if err != nil {
+				return nil, err
+			}
+			defer errorx.Defer(f.Close, &err)
+			file = f
+		}
+
+		bundle, err := blob.NewReader(file, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if bundle.Metadata.Hashes.SHA256 != expected {
+			return nil, errors.Errorf("%s: expected '%s', got '%s'", file.Name(), expected,
+				bundle.Metadata.Hashes.SHA256)
+		}
+
+		hdr, err := blobHeader(bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Version == version {
+			if hdr.Refs == nil {
+				return nil, errors.Errorf("%s: the bundle doesn't include its refs", file.Name())
+			}
+
+			return &Chain{
+				Repository:   chain.Repository,
+				Version:      hdr.Version,
+				Head:         hdr.Head,
+				Refs:         hdr.Refs,
+				ObjectFormat: chain.ObjectFormat,
+			}, nil
+		}
+		expected = hdr.Parent
+	}
+
+	return nil, errors.Errorf("version %d isn't in the current chain", version)
+}
+
+// Republish the refs from generation `generation` of a remote, or from
+// `version` in the current chain if it isn't zero, as a new full bundle on
+// top of the current chain.
+//
+// The current chain becomes the first generation, so a restore can be undone
+// by restoring generation 1.
+func Restore(name string, uris []*url.URL, cacheDir string, generation int, version uint64) (err error) {
+	if generation < 1 {
+		return errors.Errorf("invalid generation: %d", generation)
+	}
+
+	r, err := openRemote(name, uris, cacheDir)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(r.close, &err)
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+
+	mirror, chain, err := syncCandidates(r, candidates, false, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	src := ""
+	from := ""
+	var restored *Chain
+	if version != 0 {
+		if version == chain.Version {
+			return errors.Errorf("version %d is the current version", version)
+		}
+
+		restored, err = chainVersion(r, chain, version)
+		if err != nil {
+			return err
+		}
+
+		// The mirror has the objects of every version in the chain.
+		src = mirror.Path
+		from = "the current chain"
+	} else {
+		genMirror, genChain, err := syncGeneration(r, generation, tmpDir)
+		if err != nil {
+			return err
+		}
+
+		if genChain.Repository != chain.Repository {
+			return errors.Errorf("%s: repository '%s' doesn't match '%s'", generationURL(r.uri, generation),
+				genChain.Repository, chain.Repository)
+		}
+
+		if genChain.ObjectFormat != chain.ObjectFormat {
+			return errors.Errorf("%s: object format %s doesn't match %s", generationURL(r.uri, generation),
+				genChain.ObjectFormat, chain.ObjectFormat)
+		}
+
+		restored = genChain
+		src = genMirror.Path
+		from = fmt.Sprintf("generation %d", generation)
+	}
+
+	repo, err := mirror.workspace(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	err = applyBundle(src, repo, restored.Refs)
+	if err != nil {
+		return err
+	}
+
+	head := restored.Head
+	if _, ok := restored.Refs[head]; !ok {
+		head, err = defaultHead(chain, restored.Refs, repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("restoring version %d from %s as version %d", restored.Version, from, chain.Version+1)
+	_, err = pushBundle(r, candidates, mirror, tmpDir, chain, repo, restored.Refs, head, pushFull)
+	return err
+}
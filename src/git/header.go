@@ -0,0 +1,162 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/illikainen/go-utils/src/stringx"
+	"github.com/pkg/errors"
+)
+
+// Header is written in front of the Git bundle in the payload of a sealed
+// blob.
+//
+// The signed metadata in a sealed blob includes the hashes of the payload, so
+// the header is covered by the same signature as the bundle itself.
+type Header struct {
+	// Format of the header.
+	Format int
+
+	// Random identifier that is generated on the first push to a remote.
+	// It's used to detect bundles from another remote being substituted
+	// for the bundles of this remote.
+	Repository string
+
+	// Monotonically increasing version of the remote.  Every pushed
+	// bundle increments the version of its parent by one.
+	Version uint64
+
+	// Time when the bundle was created.
+	Timestamp int64
+
+	// Position of the bundle in its chain.  A full bundle has index 0 and
+	// every incremental bundle on top of it increments the index by one.
+	Index int
+
+	// SHA2-256 of the sealed full bundle that an incremental bundle builds
+	// on.  Empty for full bundles.
+	Base string
+
+	// SHA2-256 of the sealed bundle that was the tip of the remote when
+	// this bundle was created.
+	Parent string
+
+	// Object format of the repository (`sha1` or `sha256`).  Empty for
+	// bundles created by older versions, which only support SHA-1.
+	ObjectFormat string
+
+	// Ref that HEAD points to after the bundle has been applied.  Empty
+	// for bundles created by older versions.
+	Head string
+
+	// Every ref in the repository after the bundle has been applied.
+	// Incremental bundles only include the refs that were updated, so
+	// this is used to reconstruct the complete set of refs (including
+	// deletions).
+	Refs map[string]string
+
+	// Refs that were created, updated or deleted by the push that created
+	// the bundle.  Empty for bundles created by older versions.
+	Updates []*RefUpdate
+}
+
+const HeaderFormat = 1
+
+const headerMagic = "# git-remote-bundle v1\n"
+
+var ErrInvalidHeader = errors.New("invalid header")
+
+func writeHeader(w io.Writer, hdr *Header) error {
+	data, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+
+	if bytes.ContainsAny(data, "\r\n") {
+		return errors.Wrap(ErrInvalidHeader, "header contains newlines")
+	}
+
+	_, err = w.Write([]byte(headerMagic))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Read the header from the payload of a sealed blob.
+//
+// Blobs created by older versions don't have a header.  In that case, an empty
+// header is returned together with a reader for the entire payload.
+func readHeader(r io.Reader) (*Header, io.Reader, error) {
+	buf := bufio.NewReader(r)
+
+	magic, err := buf.Peek(len(headerMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	if string(magic) != headerMagic {
+		return &Header{}, buf, nil
+	}
+
+	_, err = buf.Discard(len(headerMagic))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	line, err := buf.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, errors.Wrap(ErrInvalidHeader, err.Error())
+	}
+
+	if stringx.Sanitize(string(line)) != string(line) {
+		return nil, nil, errors.Wrap(ErrInvalidHeader, "header contains invalid characters")
+	}
+
+	hdr := &Header{}
+	err = json.Unmarshal(line, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hdr.Format != HeaderFormat {
+		return nil, nil, errors.Wrapf(ErrInvalidHeader, "unsupported format %d", hdr.Format)
+	}
+
+	err = hdr.verifyOIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hdr, buf, nil
+}
+
+// Verify that the object IDs of the refs in the header are in the object
+// format of the header.
+func (hdr *Header) verifyOIDs() error {
+	format := hdr.ObjectFormat
+	if format == "" {
+		format = "sha1"
+	}
+
+	for ref, oid := range hdr.Refs {
+		if !validOID(oid, format) {
+			return errors.Wrapf(ErrInvalidHeader, "%s: invalid %s object ID '%s'", ref, format, oid)
+		}
+	}
+
+	for _, update := range hdr.Updates {
+		for _, oid := range []string{update.Old, update.New} {
+			if oid != "" && !validOID(oid, format) {
+				return errors.Wrapf(ErrInvalidHeader, "%s: invalid %s object ID '%s'", update.Ref,
+					format, oid)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package git_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/illikainen/git-remote-bundle/src/cmd"
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/asymmetric"
+	"github.com/illikainen/go-cryptor/src/blob"
+	log "github.com/sirupsen/logrus"
+)
+
+// The test binary doubles as the remote helper when it's executed by Git
+// through the wrapper that is installed by newTestEnv.
+const helperEnv = "GIT_REMOTE_BUNDLE_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "1" {
+		log.SetOutput(os.Stderr)
+
+		err := cmd.Command().Execute()
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// An isolated environment with its own global Git configuration, keys and
+// cache, where `bundle::` URLs are handled by the test binary.
+type testEnv struct {
+	t   *testing.T
+	dir string
+	env []string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the helper wrapper is a shell script")
+	}
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	home := filepath.Join(dir, "home")
+	for _, path := range []string{bin, home} {
+		err := os.Mkdir(path, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapper := fmt.Sprintf("#!/bin/sh\n%s=1 exec '%s' --sandbox none \"$@\"\n", helperEnv, exe)
+	err = os.WriteFile(filepath.Join(bin, "git-remote-bundle"), []byte(wrapper), 0700) // #nosec G306
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables like GIT_DIR from an outer Git command would leak into the
+	// repositories of the test.
+	env := []string{}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "GIT_") {
+			env = append(env, v)
+		}
+	}
+
+	e := &testEnv{
+		t:   t,
+		dir: dir,
+		env: append(env,
+			"HOME="+home,
+			"XDG_CONFIG_HOME="+filepath.Join(home, ".config"),
+			"GIT_CONFIG_GLOBAL="+filepath.Join(home, ".gitconfig"),
+			"GIT_CONFIG_NOSYSTEM=1",
+			"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		),
+	}
+
+	e.genkey("key")
+	for key, value := range map[string]string{
+		"user.name":          "test",
+		"user.email":         "test@example.com",
+		"init.defaultBranch": "main",
+		"bundle.verbosity":   "info",
+		"bundle.cacheDir":    filepath.Join(dir, "cache"),
+		"bundle.privKey":     filepath.Join(dir, "key.priv"),
+		"bundle.pubKeys":     filepath.Join(dir, "key.pub"),
+	} {
+		e.git("", "config", "--global", key, value)
+	}
+
+	return e
+}
+
+// Generate a keypair in `<dir>/<name>.pub` and `<dir>/<name>.priv` and return
+// its fingerprint.
+func (e *testEnv) genkey(name string) string {
+	e.t.Helper()
+
+	pubKey, privKey, err := asymmetric.GenerateKey(0)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	err = pubKey.Write(filepath.Join(e.dir, name+".pub"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	err = privKey.Write(filepath.Join(e.dir, name+".priv"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return pubKey.Fingerprint()
+}
+
+// The path to `name` in the environment.
+func (e *testEnv) path(name string) string {
+	return filepath.Join(e.dir, name)
+}
+
+// The `bundle::` URL of a remote named `name` in the environment.
+func (e *testEnv) url(name string) string {
+	return "bundle::file://" + filepath.Join(e.dir, "remotes", name)
+}
+
+func (e *testEnv) command(repo string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = e.dir
+	if repo != "" {
+		cmd.Dir = e.path(repo)
+	}
+	cmd.Env = e.env
+	return cmd
+}
+
+// Run a command of the helper in `repo` and return its output.  The test fails
+// if the command fails.
+func (e *testEnv) helper(repo string, args ...string) string {
+	e.t.Helper()
+
+	cmd := exec.Command(filepath.Join(e.dir, "bin", "git-remote-bundle"), args...)
+	cmd.Dir = e.path(repo)
+	cmd.Env = e.env
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		e.t.Fatalf("git-remote-bundle %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return string(out)
+}
+
+// Run a command of the helper in `repo` and return its output.  The test fails
+// if the command succeeds.
+func (e *testEnv) helperFail(repo string, args ...string) string {
+	e.t.Helper()
+
+	cmd := exec.Command(filepath.Join(e.dir, "bin", "git-remote-bundle"), args...)
+	cmd.Dir = e.path(repo)
+	cmd.Env = e.env
+
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		e.t.Fatalf("git-remote-bundle %s: unexpected success\n%s", strings.Join(args, " "), out)
+	}
+
+	return string(out)
+}
+
+// Run Git in `repo` and return its output.  The test fails if Git fails.
+func (e *testEnv) git(repo string, args ...string) string {
+	e.t.Helper()
+
+	out, err := e.command(repo, args...).CombinedOutput()
+	if err != nil {
+		e.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return string(out)
+}
+
+// Run Git in `repo` and return its output.  The test fails if Git succeeds.
+func (e *testEnv) gitFail(repo string, args ...string) string {
+	e.t.Helper()
+
+	out, err := e.command(repo, args...).CombinedOutput()
+	if err == nil {
+		e.t.Fatalf("git %s: unexpected success\n%s", strings.Join(args, " "), out)
+	}
+
+	return string(out)
+}
+
+// Create a repository named `name` with an initial commit and a remote named
+// `origin` that points to the remote named `remote`.
+func (e *testEnv) initRepo(name string, remote string) {
+	e.t.Helper()
+
+	err := os.MkdirAll(filepath.Join(e.dir, "remotes"), 0700)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	e.git("", "init", "--quiet", name)
+	e.git(name, "remote", "add", "origin", e.url(remote))
+	e.commit(name, "initial")
+}
+
+// Commit a change to `repo` and return the new commit.
+func (e *testEnv) commit(repo string, msg string) string {
+	e.t.Helper()
+
+	err := os.WriteFile(filepath.Join(e.path(repo), "file"), []byte(msg+"\n"), 0600)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	e.git(repo, "add", "file")
+	e.git(repo, "commit", "--quiet", "--message", msg)
+	return e.revParse(repo, "HEAD")
+}
+
+func (e *testEnv) revParse(repo string, rev string) string {
+	e.t.Helper()
+	return strings.TrimSpace(e.git(repo, "rev-parse", "--verify", "--quiet", rev))
+}
+
+// Whether `name` exists in the remotes directory.
+func (e *testEnv) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(e.dir, "remotes", name))
+	return err == nil
+}
+
+// Whether the helper output in `out` reports an upload to `name` in the
+// remotes directory.
+func (e *testEnv) uploaded(out string, name string) bool {
+	return strings.Contains(out, fmt.Sprintf("to 'file://%s'", filepath.Join(e.dir, "remotes", name)))
+}
+
+// Modify the manifest of the remote named `remote` with `fn` and seal it again
+// with the key named `key`.
+func (e *testEnv) resealManifest(remote string, key string, fn func(manifest map[string]interface{})) {
+	e.t.Helper()
+
+	const magic = "# git-remote-bundle manifest v1\n"
+	path := filepath.Join(e.dir, "remotes", remote+".manifest")
+
+	keys, err := blob.ReadKeyring(e.path(key+".priv"), []string{e.path("key.pub"), e.path(key + ".pub")})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	opts := &blob.Options{Type: metadata.Name() + "-manifest", Keyring: keys}
+	f, err := os.Open(path) // #nosec G304
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer f.Close() // #nosec G307
+
+	reader, err := blob.NewReader(f, opts)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	manifest := map[string]interface{}{}
+	err = json.Unmarshal(bytes.TrimPrefix(data, []byte(magic)), &manifest)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	fn(manifest)
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	sealed, err := os.Create(path) // #nosec G304
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer sealed.Close() // #nosec G307
+
+	writer, err := blob.NewWriter(sealed, opts)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	_, err = writer.Write(append([]byte(magic), data...))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	err = writer.Sign()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+}
@@ -0,0 +1,296 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-netutils/src/transport"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Record describes a push to a remote.
+//
+// Every pushed bundle carries the ref updates of the push in its header and
+// the hash of its predecessor in `Header.Parent`.  The bundles are replaced
+// by later pushes, so the record of each push is also uploaded as a sealed
+// blob to `<url>.log.<version>`.  A record commits to the record of the
+// previous version with its hash, so the history of a remote can be verified
+// by walking the records from the current tip.
+type Record struct {
+	Format int
+
+	// Identifier of the repository.
+	Repository string
+
+	// Version and creation time of the pushed bundle.
+	Version   uint64
+	Timestamp int64
+
+	// Fingerprint of the key that signed the pushed bundle and the record.
+	Signer string
+
+	// SHA2-256 of the pushed bundle and of the bundle that was the tip of
+	// the remote before the push.
+	Bundle string
+	Parent string
+
+	// SHA2-256 of the sealed record of the previous version.  Empty if
+	// the previous version has no record.
+	Previous string
+
+	// Refs that were created, updated or deleted by the push.
+	Updates []*RefUpdate
+}
+
+// RefUpdate is a change to a ref.  An empty `Old` means that the ref was
+// created and an empty `New` means that it was deleted.
+type RefUpdate struct {
+	Ref string
+	Old string
+	New string
+}
+
+const RecordFormat = 1
+
+const recordMagic = "# git-remote-bundle record v1\n"
+
+var ErrInvalidRecord = errors.New("invalid push record")
+
+var ErrInvalidHistory = errors.New("invalid push history")
+
+func recordURL(uri *url.URL, version uint64) *url.URL {
+	rec := *uri
+	rec.Path = fmt.Sprintf("%s.log.%d", uri.Path, version)
+	rec.RawPath = ""
+	return &rec
+}
+
+// Retrieve the ref updates that turn `oldRefs` into `newRefs`.
+func refUpdates(oldRefs map[string]string, newRefs map[string]string) []*RefUpdate {
+	updates := []*RefUpdate{}
+	for _, ref := range changedRefs(oldRefs, newRefs) {
+		updates = append(updates, &RefUpdate{Ref: ref, Old: oldRefs[ref], New: newRefs[ref]})
+	}
+	return updates
+}
+
+func recordOptions(keys *blob.Keyring) *blob.Options {
+	return &blob.Options{
+		Type:      metadata.Name() + "-record",
+		Keyring:   keys,
+		Encrypted: Encrypt(),
+	}
+}
+
+// Seal `rec` and write the result to `sealed`.
+func sealRecord(sealed *os.File, rec *Record, keys *blob.Keyring) (err error) {
+	writer, err := blob.NewWriter(sealed, recordOptions(keys))
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(writer.Close, &err)
+
+	rec.Format = RecordFormat
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append([]byte(recordMagic), data...))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Sign()
+	if err != nil {
+		return err
+	}
+
+	return sealed.Sync()
+}
+
+// Read the push record from the payload of a verified blob.
+func readRecord(sealed *blob.Reader) (*Record, error) {
+	_, err := iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(recordMagic)) {
+		return nil, errors.Wrap(ErrInvalidRecord, "missing magic")
+	}
+
+	rec := &Record{}
+	err = json.Unmarshal(data[len(recordMagic):], rec)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidRecord, err.Error())
+	}
+
+	if rec.Format != RecordFormat {
+		return nil, errors.Wrapf(ErrInvalidRecord, "unsupported format %d", rec.Format)
+	}
+
+	if rec.Signer != sealed.Signer.Fingerprint() {
+		return nil, errors.Wrapf(ErrInvalidRecord, "recorded signer %s but signed by %s", rec.Signer,
+			sealed.Signer.Fingerprint())
+	}
+
+	return rec, nil
+}
+
+// Seal the push record for the bundle described by `hdr` and `pushed` and
+// write the result to a file in `tmp`.
+//
+// The record of the previous version is looked up at `r.uri`, where `chain`
+// was downloaded from.
+func createRecord(r *remote, tmp string, chain *Chain, hdr *Header, pushed *Chain,
+	keys *blob.Keyring) (*os.File, error) {
+	rec := &Record{
+		Repository: hdr.Repository,
+		Version:    hdr.Version,
+		Timestamp:  hdr.Timestamp,
+		Signer:     pushed.Signer,
+		Bundle:     pushed.Tip,
+		Parent:     hdr.Parent,
+		Updates:    hdr.Updates,
+	}
+
+	if chain != nil {
+		prev, err := r.remoteHash(recordURL(r.uri, chain.Version))
+		if err != nil {
+			return nil, err
+		}
+		rec.Previous = prev
+	}
+
+	f, err := os.Create(filepath.Join(tmp, "record")) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	err = sealRecord(f, rec, keys)
+	if err != nil {
+		return nil, errorx.Join(err, f.Close())
+	}
+
+	return f, nil
+}
+
+// Walk and verify the push history of a remote from its current tip.
+//
+// The tip is verified like on a fetch.  Each record must be signed by the key
+// that it names, describe the bundle that the next record builds on and have
+// the hash that the next record commits to.  The walk stops at the first
+// version without a record, which is either the first push or a push by an
+// older version.
+func History(name string, uris []*url.URL, cacheDir string) (err error) {
+	r, err := openRemote(name, uris, cacheDir)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(r.close, &err)
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+
+	_, chain, err := syncCandidates(r, candidates, false, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	opts := recordOptions(r.keys)
+
+	bundle := chain.Tip
+	hash := ""
+	version := chain.Version
+
+	for ; version > 0; version-- {
+		uri := recordURL(r.uri, version)
+		file, sealed, err := downloadBlob(uri, filepath.Join(tmpDir, "record"), opts)
+		if err != nil {
+			if errors.Is(err, transport.ErrNotExist) {
+				if hash == "" {
+					break
+				}
+				return errors.Wrapf(ErrInvalidHistory, "%s is missing", uri)
+			}
+			return err
+		}
+
+		rec, err := readRecord(sealed)
+		err = errorx.Join(err, file.Close())
+		if err != nil {
+			return errors.Wrap(err, uri.String())
+		}
+
+		err = r.checkRevoked(uri, sealed, rec.Version)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case hash != "" && sealed.Metadata.Hashes.SHA256 != hash:
+			return errors.Wrapf(ErrInvalidHistory, "%s: expected '%s', got '%s'", uri, hash,
+				sealed.Metadata.Hashes.SHA256)
+		case rec.Bundle != bundle:
+			return errors.Wrapf(ErrInvalidHistory, "%s: describes '%s' instead of '%s'", uri, rec.Bundle,
+				bundle)
+		case rec.Version != version || rec.Repository != chain.Repository:
+			return errors.Wrapf(ErrInvalidHistory, "%s: describes version %d of %s", uri, rec.Version,
+				rec.Repository)
+		}
+
+		log.Infof("version %d at %s by %s", rec.Version, time.Unix(rec.Timestamp, 0).UTC(), sealed.Signer)
+		for _, update := range rec.Updates {
+			switch {
+			case update.Old == "":
+				log.Infof("  create %s %s", update.Ref, update.New)
+			case update.New == "":
+				log.Infof("  delete %s %s", update.Ref, update.Old)
+			default:
+				log.Infof("  update %s %s..%s", update.Ref, update.Old, update.New)
+			}
+		}
+
+		if rec.Previous == "" {
+			version--
+			break
+		}
+
+		bundle = rec.Parent
+		hash = rec.Previous
+	}
+
+	if version == chain.Version {
+		log.Infof("%s has no recorded history", name)
+	} else if version > 0 {
+		log.Infof("versions before %d have no recorded history", version+1)
+	}
+
+	return nil
+}
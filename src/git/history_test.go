@@ -0,0 +1,77 @@
+package git_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+
+	first := e.revParse("a", "HEAD")
+	out := e.git("a", "push", "origin", "main")
+	if !e.uploaded(out, "repo.log.1") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	second := e.commit("a", "second")
+	e.git("a", "branch", "other")
+	out = e.git("a", "push", "origin", "main", "other")
+	if !e.uploaded(out, "repo.log.2") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	out = e.git("a", "push", "origin", ":other")
+	if !e.uploaded(out, "repo.log.3") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	out = e.helper("a", "log", "origin")
+	for _, line := range []string{
+		"version 3 at ",
+		"  delete refs/heads/other " + second,
+		"version 2 at ",
+		"  update refs/heads/main " + first + ".." + second,
+		"  create refs/heads/other " + second,
+		"version 1 at ",
+		"  create refs/heads/main " + first,
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("missing %q:\n%s", line, out)
+		}
+	}
+	if strings.Index(out, "version 3") > strings.Index(out, "version 2") ||
+		strings.Index(out, "version 2") > strings.Index(out, "version 1") {
+		t.Fatalf("unexpected order:\n%s", out)
+	}
+
+	// A record that the next record commits to can't be replaced.
+	data, err := os.ReadFile(filepath.Join(e.path("remotes"), "repo.log.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(e.path("remotes"), "repo.log.2"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = e.helperFail("a", "log", "origin")
+	if !strings.Contains(out, "invalid push history") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// Nor can it be removed.
+	err = os.Remove(filepath.Join(e.path("remotes"), "repo.log.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = e.helperFail("a", "log", "origin")
+	if !strings.Contains(out, "repo.log.2 is missing") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
@@ -0,0 +1,75 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hooks are local programs that are run when a push is uploaded with
+// `git push`.
+//
+// The `preUpload` hook is installed as the `pre-receive` hook in the temporary
+// repository that receives the push, so it's run by `git receive-pack` before
+// any refs are updated.  It's invoked with the path to the temporary
+// repository as its argument, with `GIT_DIR` set to it, and with a line for
+// every created, updated or deleted ref on stdin:
+//
+//	<old-oid> SP <new-oid> SP <ref> LF
+//
+// The old objects are the refs in the downloaded remote and the new objects
+// are available in the quarantine directory of the push, as for any other
+// `pre-receive` hook.  The upload is vetoed if the hook exits with a non-zero
+// status, in which case `git push` reports every ref as rejected and no
+// tracking refs are updated.
+//
+// The `postUpload` hook is run once the bundle has been uploaded, with the
+// SHA2-256 of the sealed bundle and the fingerprint of its signer as its
+// arguments.  A failure is only reported because the push can't be undone.
+//
+// The output of the hooks is written to stderr because stdout is used to
+// communicate with Git.
+
+const preUploadHook = `#!/bin/sh
+exec %s %s
+`
+
+// Install the `preUpload` hook as the `pre-receive` hook in `repo`.
+func (r *remote) installPreUpload(repo string) error {
+	hook, err := UploadHook(r.name, "preUpload")
+	if err != nil || hook == "" {
+		return err
+	}
+
+	hooks := filepath.Join(repo, "hooks")
+	err = os.MkdirAll(hooks, 0700)
+	if err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(preUploadHook, shellQuote(hook), shellQuote(repo))
+	return os.WriteFile(filepath.Join(hooks, "pre-receive"), []byte(script), 0700) // #nosec G306
+}
+
+// Run the `postUpload` hook for the pushed chain in `pushed`.
+func (r *remote) postUpload(pushed *Chain) error {
+	hook, err := UploadHook(r.name, "postUpload")
+	if err != nil || hook == "" {
+		return err
+	}
+
+	log.Infof("running %s", hook)
+	cmd := exec.Command(hook, pushed.Tip, pushed.Signer) // #nosec G204
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		log.Warnf("%s: %v", hook, err)
+	}
+
+	return nil
+}
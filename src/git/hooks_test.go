@@ -0,0 +1,74 @@
+package git_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUploadHooks(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+
+	// The hook can inspect the pushed objects and vetoes refs named
+	// `veto`.
+	preUpload := `#!/bin/sh
+while read -r old new ref; do
+	git cat-file -e "$new" || exit 1
+	echo "$ref" >>'` + e.path("pre-upload.log") + `'
+	case "$ref" in
+	*/veto) exit 1 ;;
+	esac
+done
+`
+	postUpload := `#!/bin/sh
+echo "$1 $2" >>'` + e.path("post-upload.log") + `'
+`
+	for name, script := range map[string]string{"pre-upload": preUpload, "post-upload": postUpload} {
+		err := os.WriteFile(e.path(name), []byte(script), 0700) // #nosec G306
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.git("a", "config", "bundle.preUploadHook", e.path("pre-upload"))
+	e.git("a", "config", "bundle.origin.postUploadHook", e.path("post-upload"))
+
+	e.git("a", "push", "origin", "main")
+	first := e.revParse("a", "origin/main")
+
+	e.commit("a", "vetoed")
+	out := e.gitFail("a", "push", "origin", "main", "main:veto")
+	if !strings.Contains(out, "! [remote rejected] main -> main (pre-receive hook declined)") ||
+		!strings.Contains(out, "! [remote rejected] main -> veto (pre-receive hook declined)") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	if e.revParse("a", "origin/main") != first {
+		t.Fatal("the tracking ref was updated by a vetoed push")
+	}
+
+	if strings.Contains(e.git("a", "ls-remote", "origin"), e.revParse("a", "HEAD")) {
+		t.Fatal("the vetoed push was uploaded")
+	}
+
+	e.git("a", "push", "origin", "main")
+
+	log, err := os.ReadFile(e.path("pre-upload.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(log) != "refs/heads/main\nrefs/heads/main\nrefs/heads/veto\nrefs/heads/main\n" {
+		t.Fatalf("unexpected refs for the pre-upload hook:\n%s", log)
+	}
+
+	log, err = os.ReadFile(e.path("post-upload.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(strings.Split(strings.TrimSpace(string(log)), "\n")) != 2 {
+		t.Fatalf("expected two uploads:\n%s", log)
+	}
+}
@@ -0,0 +1,59 @@
+package git
+
+import (
+	"os"
+	"time"
+
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Lock is an advisory lock on a file.
+//
+// It's used to serialize access to the cache between concurrent invocations
+// of the helper (e.g., `git fetch` in two worktrees for the same remote).
+type Lock struct {
+	file *os.File
+}
+
+var ErrLocked = errors.New("locked by another process (see `bundle.lockTimeout`)")
+
+const lockInterval = 100 * time.Millisecond
+
+// Acquire an exclusive lock on `path`.
+//
+// ErrLocked is returned if the lock can't be acquired within `timeout`.
+func LockFile(path string, timeout time.Duration) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for waited := false; ; waited = true {
+		ok, err := tryLock(f)
+		if err != nil {
+			return nil, errorx.Join(err, f.Close())
+		}
+
+		if ok {
+			log.Tracef("locked %s", path)
+			return &Lock{file: f}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errorx.Join(errors.Wrap(ErrLocked, path), f.Close())
+		}
+
+		if !waited {
+			log.Infof("waiting for lock on %s", path)
+		}
+		time.Sleep(lockInterval)
+	}
+}
+
+func (l *Lock) Unlock() error {
+	log.Tracef("unlocking %s", l.file.Name())
+	return errorx.Join(unlock(l.file), l.file.Close())
+}
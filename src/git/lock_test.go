@@ -0,0 +1,85 @@
+package git
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	lock, err := LockFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LockFile(path, 0)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected %v, got %v", ErrLocked, err)
+	}
+
+	// A waiting process gets the lock once it's released.
+	done := make(chan error)
+	go func() {
+		time.Sleep(2 * lockInterval)
+		done <- lock.Unlock()
+	}()
+
+	lock, err = LockFile(path, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err = LockFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+
+	tests := []struct {
+		config  string
+		timeout time.Duration
+		err     bool
+	}{
+		{"", 60 * time.Second, false},
+		{"'bundle.lockTimeout'='0'", 0, false},
+		{"'bundle.lockTimeout'='5'", 5 * time.Second, false},
+		{"'bundle.lockTimeout'='x'", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Setenv("GIT_CONFIG_PARAMETERS", test.config)
+
+		timeout, err := LockTimeout()
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.config, err)
+			continue
+		}
+
+		if err == nil && timeout != test.timeout {
+			t.Errorf("%q: expected %v, got %v", test.config, test.timeout, timeout)
+		}
+	}
+}
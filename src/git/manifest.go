@@ -0,0 +1,243 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+)
+
+// Manifest is a small sealed blob that is uploaded to `<url>.manifest` after
+// every push.
+//
+// It describes the refs at the tip of the remote, so refs can be advertised
+// (e.g., for `git ls-remote`) without downloading and replaying the bundles.
+// The bundles are only downloaded once the client asks for objects.
+//
+// The manifest is uploaded after the bundle it describes.  A manifest that
+// doesn't match the bundles on the remote is ignored.
+type Manifest struct {
+	Format     int
+	Repository string
+
+	// SHA2-256 of the sealed full bundle and of the tip of the chain.
+	Base string
+	Tip  string
+
+	// Number of incremental bundles on top of the full bundle.
+	Length int
+
+	// SHA2-256 of the sealed bundle that occupied the position after the
+	// tip when the manifest was uploaded.  See Chain.Next.
+	Next string
+
+	// Version and creation time of the tip.
+	Version   uint64
+	Timestamp int64
+
+	// Object format of the repository.
+	ObjectFormat string
+
+	// Ref that HEAD points to.
+	Head string
+
+	// Refs at the tip and the objects that annotated tags point to.
+	Refs   map[string]string
+	Peeled map[string]string
+}
+
+const ManifestFormat = 1
+
+const manifestMagic = "# git-remote-bundle manifest v1\n"
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+var ErrRemoteChanged = errors.New("the remote changed while it was being fetched; try again")
+
+var ErrManifestMismatch = errors.New("the manifest doesn't match the verified bundles")
+
+func manifestURL(uri *url.URL) *url.URL {
+	m := *uri
+	m.Path = uri.Path + ".manifest"
+	m.RawPath = ""
+	return &m
+}
+
+func manifestOptions(keys *blob.Keyring) *blob.Options {
+	return &blob.Options{
+		Type:      metadata.Name() + "-manifest",
+		Keyring:   keys,
+		Encrypted: Encrypt(),
+	}
+}
+
+// Seal `manifest` and write the result to `sealed`.
+func sealManifest(sealed *os.File, manifest *Manifest, keys *blob.Keyring) (err error) {
+	_, err = iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = sealed.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	writer, err := blob.NewWriter(sealed, manifestOptions(keys))
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(writer.Close, &err)
+
+	manifest.Format = ManifestFormat
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append([]byte(manifestMagic), data...))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Sign()
+	if err != nil {
+		return err
+	}
+
+	return sealed.Sync()
+}
+
+// Read the manifest from the payload of a verified blob.
+func readManifest(sealed *blob.Reader) (*Manifest, error) {
+	_, err := iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(manifestMagic)) {
+		return nil, errors.Wrap(ErrInvalidManifest, "missing magic")
+	}
+
+	manifest := &Manifest{}
+	err = json.Unmarshal(data[len(manifestMagic):], manifest)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidManifest, err.Error())
+	}
+
+	if manifest.Format != ManifestFormat {
+		return nil, errors.Wrapf(ErrInvalidManifest, "unsupported format %d", manifest.Format)
+	}
+
+	return manifest, nil
+}
+
+// Verify that the manifest describes the verified `chain` with the annotated
+// tags in `peeled`.
+func (m *Manifest) verify(chain *Chain, peeled map[string]string) error {
+	if m.Tip != chain.Tip {
+		return errors.Wrapf(ErrRemoteChanged, "'%s' != '%s'", chain.Tip, m.Tip)
+	}
+
+	mismatch := ""
+	switch {
+	case m.Repository != chain.Repository:
+		mismatch = "repository"
+	case m.Base != chain.Base:
+		mismatch = "base"
+	case m.Length != chain.Length:
+		mismatch = "length"
+	case m.Version != chain.Version:
+		mismatch = "version"
+	case m.ObjectFormat != chain.ObjectFormat:
+		mismatch = "object format"
+	case m.Head != chain.Head:
+		mismatch = "head"
+	case len(changedRefs(m.Refs, chain.Refs)) > 0:
+		mismatch = "refs"
+	case len(changedRefs(m.Peeled, peeled)) > 0:
+		mismatch = "peeled refs"
+	}
+
+	if mismatch != "" {
+		return errors.Wrapf(ErrManifestMismatch, "%s differs from version %d", mismatch, chain.Version)
+	}
+	return nil
+}
+
+// Capabilities advertised on behalf of `git upload-pack`.  The advertisement
+// is replaced before the request is handed to the real upload-pack, so this
+// must be a subset of what it supports.
+var uploadPackCapabilities = []string{
+	"multi_ack",
+	"thin-pack",
+	"side-band",
+	"side-band-64k",
+	"ofs-delta",
+	"shallow",
+	"deepen-since",
+	"deepen-not",
+	"deepen-relative",
+	"no-progress",
+	"include-tag",
+	"multi_ack_detailed",
+}
+
+// Write a protocol v0 ref advertisement for the refs in `manifest` to `w`.
+func (m *Manifest) advertise(w io.Writer) error {
+	caps := append([]string{}, uploadPackCapabilities...)
+	if _, ok := m.Refs[m.Head]; ok {
+		caps = append(caps, "symref=HEAD:"+m.Head)
+	}
+	format := m.ObjectFormat
+	if format == "" {
+		format = "sha1"
+	}
+
+	caps = append(caps, "object-format="+format, fmt.Sprintf("agent=%s/%s", metadata.Name(),
+		metadata.Version()))
+
+	lines := []string{}
+	if oid, ok := m.Refs[m.Head]; ok {
+		lines = append(lines, fmt.Sprintf("%s HEAD", oid))
+	}
+
+	for _, ref := range sortedRefs(m.Refs) {
+		lines = append(lines, fmt.Sprintf("%s %s", m.Refs[ref], ref))
+		if oid, ok := m.Peeled[ref]; ok {
+			lines = append(lines, fmt.Sprintf("%s %s^{}", oid, ref))
+		}
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, fmt.Sprintf("%s capabilities^{}", strings.Repeat("0", oidLength(format))))
+	}
+
+	for i, line := range lines {
+		if i == 0 {
+			line += "\x00" + strings.Join(caps, " ")
+		}
+
+		err := writePacket(w, []byte(line+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFlush(w)
+}
@@ -0,0 +1,125 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/asymmetric"
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-cryptor/src/cryptor"
+	"github.com/pkg/errors"
+)
+
+func TestManifestVerify(t *testing.T) {
+	chain := &Chain{
+		Repository: "repo",
+		Base:       "base",
+		Tip:        "tip",
+		Length:     1,
+		Version:    2,
+		Head:       "refs/heads/main",
+		Refs:       map[string]string{"refs/heads/main": "a", "refs/tags/v1": "b"},
+	}
+	peeled := map[string]string{"refs/tags/v1": "a"}
+
+	manifest := func(fn func(m *Manifest)) *Manifest {
+		m := &Manifest{
+			Repository: "repo",
+			Base:       "base",
+			Tip:        "tip",
+			Length:     1,
+			Version:    2,
+			Head:       "refs/heads/main",
+			Refs:       map[string]string{"refs/heads/main": "a", "refs/tags/v1": "b"},
+			Peeled:     map[string]string{"refs/tags/v1": "a"},
+		}
+		fn(m)
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		manifest *Manifest
+		err      error
+	}{
+		{"match", manifest(func(m *Manifest) {}), nil},
+		{"tip", manifest(func(m *Manifest) { m.Tip = "other" }), ErrRemoteChanged},
+		{"repository", manifest(func(m *Manifest) { m.Repository = "other" }), ErrManifestMismatch},
+		{"base", manifest(func(m *Manifest) { m.Base = "other" }), ErrManifestMismatch},
+		{"length", manifest(func(m *Manifest) { m.Length = 2 }), ErrManifestMismatch},
+		{"version", manifest(func(m *Manifest) { m.Version = 1000 }), ErrManifestMismatch},
+		{"head", manifest(func(m *Manifest) { m.Head = "refs/heads/other" }), ErrManifestMismatch},
+		{"changed ref", manifest(func(m *Manifest) { m.Refs["refs/heads/main"] = "c" }), ErrManifestMismatch},
+		{"extra ref", manifest(func(m *Manifest) { m.Refs["refs/heads/other"] = "a" }), ErrManifestMismatch},
+		{"missing ref", manifest(func(m *Manifest) { delete(m.Refs, "refs/tags/v1") }), ErrManifestMismatch},
+		{"peeled", manifest(func(m *Manifest) { m.Peeled = nil }), ErrManifestMismatch},
+	}
+
+	for _, test := range tests {
+		err := test.manifest.verify(chain, peeled)
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestBlobTypes(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+
+	pubKey, privKey, err := asymmetric.GenerateKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &blob.Keyring{Public: []cryptor.PublicKey{pubKey}, Private: privKey}
+
+	kinds := map[string]*blob.Options{
+		"bundle":      {Type: metadata.Name(), Keyring: keys, Encrypted: Encrypt()},
+		"manifest":    manifestOptions(keys),
+		"signature":   signatureOptions(keys),
+		"record":      recordOptions(keys),
+		"revocations": revocationsOptions(keys),
+	}
+
+	for name, opts := range kinds {
+		f, err := os.Create(filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close() // #nosec G307
+
+		writer, err := blob.NewWriter(f, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = writer.Write([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = writer.Sign()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = writer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for other, otherOpts := range kinds {
+			_, err := blob.NewReader(f, otherOpts)
+			if other == name && err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+
+			if other != name && err == nil {
+				t.Errorf("%s was accepted as %s", name, other)
+			}
+		}
+	}
+}
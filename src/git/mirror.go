@@ -0,0 +1,176 @@
+package git
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mirror is a persistent bare repository in the cache that is kept in sync
+// with the verified bundles of a remote.
+//
+// Only the bundles that haven't been applied yet are unbundled into the
+// mirror, so an unchanged remote doesn't have to be cloned again.
+//
+// The state is removed before the repository is modified and saved once the
+// modification has been verified.  A mirror without a state is rebuilt from
+// scratch.
+type Mirror struct {
+	// Path to the bare repository.
+	Path string `json:"-"`
+
+	// SHA2-256 of the sealed full bundle that the mirror was built from.
+	Base string
+
+	// SHA2-256 of the last sealed bundle that was applied.
+	Tip string
+
+	// Number of incremental bundles applied on top of Base.
+	Length int
+
+	statePath string
+}
+
+var errMirrorStale = errors.New("the mirror is ahead of the remote")
+
+func openMirror(dir string) (*Mirror, error) {
+	m := &Mirror{
+		Path:      filepath.Join(dir, "mirror"),
+		statePath: filepath.Join(dir, "mirror.json"),
+	}
+
+	data, err := os.ReadFile(m.statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, errors.Wrap(err, m.statePath)
+	}
+
+	exists, err := iofs.Exists(m.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return m, m.invalidate()
+	}
+
+	return m, nil
+}
+
+// Mark the mirror as being modified.
+func (m *Mirror) invalidate() error {
+	m.Base = ""
+	m.Tip = ""
+	m.Length = 0
+
+	err := os.Remove(m.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (m *Mirror) save(base string, tip string, length int) error {
+	m.Base = base
+	m.Tip = tip
+	m.Length = length
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := m.statePath + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.statePath)
+}
+
+// Replace the mirror with an empty repository with the object format in
+// `format`.
+func (m *Mirror) reset(format string) error {
+	log.Tracef("initializing bare repo in %s", m.Path)
+
+	err := m.invalidate()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(m.Path)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("git", "init", "--quiet", "--bare", "--object-format="+format,
+		m.Path).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("%s: %v", out, err)
+	}
+
+	return m.save("", "", 0)
+}
+
+// Create a temporary repository for `git receive-pack` in `dir`.
+//
+// The objects in the mirror are shared with the temporary repository, so the
+// mirror is only updated once a push has been uploaded.
+//
+// The repository is initialized explicitly rather than with `git clone
+// --shared` because a clone of an empty repository always gets the default
+// object format.
+func (m *Mirror) workspace(dir string) (string, error) {
+	repo := filepath.Join(dir, "workspace")
+
+	format, err := objectFormat(m.Path)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command("git", "init", "--quiet", "--bare", "--object-format="+format,
+		repo).CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("%s: %v", out, err)
+	}
+
+	alternates := filepath.Join(repo, "objects", "info", "alternates")
+	err = os.WriteFile(alternates, []byte(filepath.Join(m.Path, "objects")+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	out, err = exec.Command("git", "--git-dir", repo, "fetch", "--quiet", "--no-write-fetch-head",
+		m.Path, "+refs/*:refs/*").CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("%s: %v", out, err)
+	}
+
+	head, err := headRef(m.Path)
+	if err != nil {
+		return "", err
+	}
+
+	if head != "" {
+		out, err := exec.Command("git", "--git-dir", repo, "symbolic-ref", "HEAD", head).CombinedOutput()
+		if err != nil {
+			return "", errors.Errorf("%s: %v", out, err)
+		}
+	}
+
+	return repo, nil
+}
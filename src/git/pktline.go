@@ -0,0 +1,74 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+)
+
+// Maximum length of a pkt-line, including the length prefix.
+const maxPacketSize = 65520
+
+var ErrInvalidPacket = errors.New("invalid pkt-line")
+
+// Returned instead of a packet for a delim-pkt, which separates the sections
+// of a protocol v2 request.
+var errDelimPacket = errors.New("delim-pkt")
+
+// Read a pkt-line from `r`.
+//
+// A nil slice is returned for a flush-pkt.
+func readPacket(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 4)
+	err := iofs.ReadFull(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseUint(string(prefix), 16, 16)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidPacket, "%q", prefix)
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	if size == 1 {
+		return nil, errDelimPacket
+	}
+
+	if size < 4 || size > maxPacketSize {
+		return nil, errors.Wrapf(ErrInvalidPacket, "size %d", size)
+	}
+
+	data := make([]byte, size-4)
+	err = iofs.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func writePacket(w io.Writer, data []byte) error {
+	if len(data)+4 > maxPacketSize {
+		return errors.Wrapf(ErrInvalidPacket, "size %d", len(data)+4)
+	}
+
+	_, err := fmt.Fprintf(w, "%04x%s", len(data)+4, data)
+	return err
+}
+
+func writeFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+func writeDelim(w io.Writer) error {
+	_, err := io.WriteString(w, "0001")
+	return err
+}
@@ -0,0 +1,89 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		input string
+		pkt   []byte
+		err   error
+	}{
+		{"000ahello\n", []byte("hello\n"), nil},
+		{"0004", []byte{}, nil},
+		{"0000", nil, nil},
+		{"0001", nil, errDelimPacket},
+		{"0002", nil, ErrInvalidPacket},
+		{"zzzz", nil, ErrInvalidPacket},
+		{"fff1", nil, ErrInvalidPacket},
+		{"000ahel", nil, io.ErrUnexpectedEOF},
+		{"00", nil, io.ErrUnexpectedEOF},
+		{"", nil, io.EOF},
+	}
+
+	for _, test := range tests {
+		pkt, err := readPacket(strings.NewReader(test.input))
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%q: expected %v, got %v", test.input, test.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+
+		if (pkt == nil) != (test.pkt == nil) || !bytes.Equal(pkt, test.pkt) {
+			t.Errorf("%q: expected %q, got %q", test.input, test.pkt, pkt)
+		}
+	}
+}
+
+func TestWritePacket(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, data := range []string{"hello\n", "", "version 2\n"} {
+		err := writePacket(buf, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := writeDelim(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeFlush(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "000ahello\n0004000eversion 2\n00010000"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	for _, data := range []string{"hello\n", "", "version 2\n"} {
+		pkt, err := readPacket(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(pkt) != data {
+			t.Errorf("expected %q, got %q", data, pkt)
+		}
+	}
+
+	err = writePacket(buf, make([]byte, maxPacketSize-3))
+	if !errors.Is(err, ErrInvalidPacket) {
+		t.Errorf("expected %v for an oversized packet, got %v", ErrInvalidPacket, err)
+	}
+}
@@ -0,0 +1,208 @@
+package git
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy maps the fingerprints of signers to the patterns for the refs that
+// they're allowed to create, update and delete.  A nil policy allows every
+// signer in the keyring to change any ref.
+type Policy map[string][]string
+
+var ErrUnauthorized = errors.New("the signer isn't authorized to change the ref")
+
+// Verify that `signer` is allowed to change the refs in `oldRefs` into the
+// refs in `newRefs`.
+func (p Policy) authorize(signer string, oldRefs map[string]string, newRefs map[string]string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, ref := range changedRefs(oldRefs, newRefs) {
+		allowed := false
+		for _, pattern := range p[signer] {
+			if matchRef(ref, pattern) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return errors.Wrapf(ErrUnauthorized, "%s may not change %s", signer, ref)
+		}
+	}
+
+	return nil
+}
+
+// Verify that the signer of the full bundle in `chain` is allowed to make the
+// changes between the bundle that it replaced and `chain`.
+//
+// The replaced bundle is the `parent` in the header of the full bundle.  Its
+// refs are taken from the last verified chain if that is the parent, and
+// otherwise from the first generation of the remote, where the replaced
+// chain is kept.  If the parent can't be found (e.g., because generations
+// are disabled), the full bundle is compared with the last verified chain
+// instead, which may reject a valid full bundle if other pushes have been
+// missed in between.
+//
+// Incremental bundles are authorized against their own parents when they're
+// applied.  The first full bundle that is fetched from a remote is trusted
+// as-is because there's nothing to compare it with.
+func (r *remote) authorizeBase(chain *Chain, parent string, opts *blob.Options) error {
+	if r.policy == nil {
+		return nil
+	}
+
+	prev, err := readChain(r.chainPath())
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		log.Infof("trusting the refs in %s on the first fetch", r.uri)
+		return nil
+	}
+
+	if prev.Base == chain.Base {
+		return nil
+	}
+
+	oldRefs := prev.Refs
+	if parent != "" && parent != prev.Tip {
+		refs, err := r.generationRefs(parent, opts)
+		if err != nil {
+			return err
+		}
+
+		if refs != nil {
+			oldRefs = refs
+		} else {
+			log.Warnf("%s: the replaced bundle %s isn't available; authorizing against the last "+
+				"verified version %d", r.uri, parent, prev.Version)
+		}
+	}
+
+	return r.policy.authorize(chain.Signer, oldRefs, chain.Refs)
+}
+
+// Verify that `signer` is allowed to make the changes between the last
+// verified chain and the refs advertised by `manifest`.
+//
+// The refs in a manifest are advertised before the bundles are verified, so
+// a signer that is restricted by the policy could otherwise advertise refs
+// that it isn't allowed to push.  A manifest that can't be authorized is
+// ignored (and the bundles are verified before anything is advertised).  This
+// includes manifests that describe changes by other signers since the last
+// fetch, and every manifest on the first fetch.
+func (r *remote) authorizeManifest(signer string, manifest *Manifest) error {
+	if r.policy == nil {
+		return nil
+	}
+
+	prev, err := readChain(r.chainPath())
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		return errors.Wrap(ErrUnauthorized, "no verified refs to compare the manifest with")
+	}
+
+	return r.policy.authorize(signer, prev.Refs, manifest.Refs)
+}
+
+// Retrieve the refs of the bundle with the SHA2-256 in `hash` from the first
+// generation of the remote.  Nil is returned if there's no such bundle.
+func (r *remote) generationRefs(hash string, opts *blob.Options) (refs map[string]string, err error) {
+	gen := generationURL(r.uri, 1)
+
+	for index := 0; ; index++ {
+		uri := gen
+		if index > 0 {
+			uri = incrementalURL(gen, index)
+		}
+
+		cur, err := r.remoteHash(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		if cur == "" {
+			return nil, nil
+		}
+
+		if cur == hash {
+			return r.blobRefs(uri, hash, opts)
+		}
+	}
+}
+
+// Download and verify the bundle at `uri` and retrieve its refs.
+func (r *remote) blobRefs(uri *url.URL, hash string, opts *blob.Options) (refs map[string]string, err error) {
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return nil, err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	f, err := os.Create(filepath.Join(tmpDir, "bundle")) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer errorx.Defer(f.Close, &err)
+
+	bundle, err := blob.Download(uri, f, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if bundle.Metadata.Hashes.SHA256 != hash {
+		return nil, errors.Errorf("%s: expected '%s', got '%s'", uri, hash, bundle.Metadata.Hashes.SHA256)
+	}
+
+	hdr, err := blobHeader(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkRevoked(uri, bundle, hdr.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Refs == nil {
+		return nil, errors.Errorf("%s: the bundle doesn't include its refs", uri)
+	}
+
+	return hdr.Refs, nil
+}
+
+// Retrieve the refs that are created, updated or deleted between `oldRefs` and
+// `newRefs`.
+func changedRefs(oldRefs map[string]string, newRefs map[string]string) []string {
+	changed := []string{}
+	for ref, oid := range newRefs {
+		if oldRefs[ref] != oid {
+			changed = append(changed, ref)
+		}
+	}
+
+	for ref := range oldRefs {
+		if _, ok := newRefs[ref]; !ok {
+			changed = append(changed, ref)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
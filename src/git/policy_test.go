@@ -0,0 +1,141 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestAuthorize(t *testing.T) {
+	policy := Policy{
+		"alice": {"refs/heads/*", "refs/tags/*"},
+		"bob":   {"refs/heads/bob/*", "refs/heads/docs"},
+	}
+
+	oldRefs := map[string]string{
+		"refs/heads/main":  "1",
+		"refs/heads/docs":  "2",
+		"refs/tags/v1":     "3",
+		"refs/heads/bob/x": "4",
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		signer  string
+		newRefs map[string]string
+		ok      bool
+	}{
+		{
+			name:    "unchanged",
+			policy:  policy,
+			signer:  "mallory",
+			newRefs: oldRefs,
+			ok:      true,
+		},
+		{
+			name:    "no policy",
+			policy:  nil,
+			signer:  "mallory",
+			newRefs: map[string]string{},
+			ok:      true,
+		},
+		{
+			name:   "allowed update",
+			policy: policy,
+			signer: "bob",
+			newRefs: map[string]string{
+				"refs/heads/main":  "1",
+				"refs/heads/docs":  "5",
+				"refs/tags/v1":     "3",
+				"refs/heads/bob/x": "6",
+				"refs/heads/bob/y": "7",
+			},
+			ok: true,
+		},
+		{
+			name:   "disallowed update",
+			policy: policy,
+			signer: "bob",
+			newRefs: map[string]string{
+				"refs/heads/main":  "5",
+				"refs/heads/docs":  "2",
+				"refs/tags/v1":     "3",
+				"refs/heads/bob/x": "4",
+			},
+			ok: false,
+		},
+		{
+			name:   "disallowed deletion",
+			policy: policy,
+			signer: "bob",
+			newRefs: map[string]string{
+				"refs/heads/main":  "1",
+				"refs/heads/docs":  "2",
+				"refs/heads/bob/x": "4",
+			},
+			ok: false,
+		},
+		{
+			name:   "unknown signer",
+			policy: policy,
+			signer: "mallory",
+			newRefs: map[string]string{
+				"refs/heads/main":  "1",
+				"refs/heads/docs":  "2",
+				"refs/tags/v1":     "3",
+				"refs/heads/bob/x": "4",
+				"refs/heads/new":   "5",
+			},
+			ok: false,
+		},
+		{
+			name:    "allowed deletion",
+			policy:  policy,
+			signer:  "alice",
+			newRefs: map[string]string{},
+			ok:      true,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.policy.authorize(test.signer, oldRefs, test.newRefs)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		if !test.ok && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: expected %v, got %v", test.name, ErrUnauthorized, err)
+		}
+	}
+}
+
+func TestRefUpdates(t *testing.T) {
+	oldRefs := map[string]string{
+		"refs/heads/a": "1",
+		"refs/heads/b": "2",
+		"refs/heads/c": "3",
+	}
+
+	newRefs := map[string]string{
+		"refs/heads/a": "1",
+		"refs/heads/b": "4",
+		"refs/heads/d": "5",
+	}
+
+	expected := []*RefUpdate{
+		{Ref: "refs/heads/b", Old: "2", New: "4"},
+		{Ref: "refs/heads/c", Old: "3", New: ""},
+		{Ref: "refs/heads/d", Old: "", New: "5"},
+	}
+
+	updates := refUpdates(oldRefs, newRefs)
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("expected %+v, got %+v", expected, updates)
+	}
+
+	if len(refUpdates(oldRefs, oldRefs)) != 0 {
+		t.Error("unchanged refs have updates")
+	}
+}
@@ -0,0 +1,126 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The `update` hook that is installed in the temporary repository that
+// receives a push.
+//
+// `git receive-pack` runs the hook once for every updated ref with the name of
+// the ref, the old object and the new object.  The old object is the ref in
+// the downloaded remote, so settings like `receive.denyNonFastForwards` in the
+// configuration of the remote have nothing to act on.  Refs that are rejected
+// by the hook are reported per ref to `git push` while the other refs are
+// accepted.
+const updateHook = `#!/bin/sh
+ref="$1"
+old="$2"
+new="$3"
+`
+
+// Rejects refs that don't match any of the patterns in the first verb,
+// with the message in the second verb.
+const includeCheck = `
+case "$ref" in
+%s) ;;
+*)
+	echo "$ref" %s >&2
+	exit 1
+	;;
+esac
+`
+
+// Rejects every ref when a check has no patterns, because an empty pattern
+// isn't valid in a `case` statement.
+const rejectCheck = `
+echo "$ref" %s >&2
+exit 1
+`
+
+// Rejects deletions and non-fast-forward updates of the refs in
+// `bundle.<remote>.protect`.
+const protectCheck = `
+case "$ref" in
+%s)
+	case "$new" in
+	*[!0]*) ;;
+	*)
+		echo "$ref is protected against deletion" >&2
+		exit 1
+		;;
+	esac
+
+	case "$old" in
+	*[!0]*)
+		if ! git merge-base --is-ancestor "$old" "$new" 2>/dev/null; then
+			echo "$ref is protected against non-fast-forward updates" >&2
+			exit 1
+		fi
+		;;
+	esac
+	;;
+esac
+`
+
+// Install the `update` hook in `repo` that rejects refs that are excluded from
+// the bundles of the remote, refs that we're not allowed to change by the
+// policy of the remote, and deletions and non-fast-forward updates of
+// protected refs.
+//
+// Excluded refs would be accepted by `git push` without ever reaching the
+// remote, and unauthorized refs would make the upload fail after the other
+// refs had been accepted.
+func (r *remote) installUpdateHook(repo string) error {
+	hook := updateHook
+	hook += refCheck(r.refs, fmt.Sprintf("is excluded from the bundle by `bundle.%s.refs`", r.name))
+
+	if r.policy != nil && r.keys.Private != nil {
+		hook += refCheck(r.policy[r.keys.Private.Fingerprint()],
+			fmt.Sprintf("may not be changed by this key according to `bundle.%s.authorize`", r.name))
+	}
+
+	if len(r.protected) > 0 {
+		hook += fmt.Sprintf(protectCheck, shellPatterns(r.protected))
+	}
+
+	hooks := filepath.Join(repo, "hooks")
+	err := os.MkdirAll(hooks, 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(hooks, "update"), []byte(hook), 0700) // #nosec G306
+}
+
+// Build a check for the `update` hook that rejects refs that don't match any of
+// the patterns in `patterns`.
+func refCheck(patterns []string, msg string) string {
+	if len(patterns) == 0 {
+		return fmt.Sprintf(rejectCheck, shellQuote(msg))
+	}
+	return fmt.Sprintf(includeCheck, shellPatterns(patterns), shellQuote(msg))
+}
+
+// Convert ref patterns in the format of `bundle.<remote>.refs` to a pattern
+// for a `case` statement in a shell script.
+func shellPatterns(patterns []string) string {
+	cases := []string{}
+	for _, pattern := range patterns {
+		prefix, suffix, glob := strings.Cut(pattern, "*")
+		if glob {
+			cases = append(cases, shellQuote(prefix)+"*"+shellQuote(suffix))
+		} else {
+			cases = append(cases, shellQuote(pattern))
+		}
+	}
+
+	return strings.Join(cases, "|")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
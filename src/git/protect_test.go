@@ -0,0 +1,235 @@
+package git_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illikainen/go-cryptor/src/asymmetric"
+)
+
+func TestExcludedRefs(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.origin.refs", "refs/heads/*")
+
+	e.git("a", "tag", "v1")
+	out := e.gitFail("a", "push", "origin", "main", "v1")
+	if !strings.Contains(out, "! [remote rejected] v1 -> v1 (hook declined)") ||
+		!strings.Contains(out, "* [new branch]      main -> main") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	if e.revParse("a", "refs/remotes/origin/main") == "" {
+		t.Fatal("the accepted ref wasn't tracked")
+	}
+
+	out = e.git("a", "ls-remote", "origin")
+	if !strings.Contains(out, "refs/heads/main") || strings.Contains(out, "refs/tags/v1") {
+		t.Fatalf("unexpected refs:\n%s", out)
+	}
+}
+
+func TestProtectedRefs(t *testing.T) {
+	e := newTestEnv(t)
+	e.initRepo("a", "repo")
+	e.git("a", "config", "--add", "bundle.origin.protect", "refs/heads/main")
+	e.git("a", "config", "--add", "bundle.origin.protect", "refs/heads/keep/*")
+	e.git("a", "push", "origin", "main", "main:other", "main:keep/x")
+
+	first := e.revParse("a", "HEAD")
+	e.commit("a", "second")
+	e.git("a", "push", "origin", "main")
+
+	e.git("a", "reset", "--quiet", "--hard", first)
+	out := e.gitFail("a", "push", "--force", "origin", "main")
+	if !strings.Contains(out, "! [remote rejected] main -> main (hook declined)") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	out = e.gitFail("a", "push", "origin", "--delete", "keep/x")
+	if !strings.Contains(out, "! [remote rejected] keep/x (hook declined)") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// Unprotected refs can be rewritten and deleted.
+	e.git("a", "push", "--force", "origin", "main:other")
+	e.git("a", "push", "origin", "--delete", "other")
+}
+
+func TestAuthorizedRefs(t *testing.T) {
+	e := newTestEnv(t)
+	bob := e.genkey("bob")
+
+	pubKey, err := asymmetric.ReadPublicKey(e.path("key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "--add", "bundle.origin.authorize", pubKey.Fingerprint()+" refs/heads/*")
+	e.git("", "config", "--global", "--add", "bundle.origin.authorize", bob+" refs/heads/docs")
+	e.git("", "config", "--global", "bundle.origin.signerChange", "warn")
+	e.git("", "config", "--global", "bundle.consolidate", "1")
+
+	// The first repository has its own cache so that it doesn't see the
+	// bundles that are pushed by the others.
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+	cache := "bundle.cacheDir=" + e.path("cache")
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	e.git("a", "push", "origin", "main", "main:docs")
+
+	// An incremental bundle that changes main, which is missed by the first
+	// repository.
+	e.git("", "clone", "--quiet", "--config", cache, e.url("repo"), "c")
+	e.commit("c", "c")
+	e.git("c", "push", "origin", "main")
+
+	e.git("", "clone", "--quiet", "--config", cache, e.url("repo"), "b")
+	e.git("b", "config", "bundle.privKey", e.path("bob.priv"))
+	e.commit("b", "b")
+	out := e.gitFail("b", "push", "origin", "HEAD:main", "HEAD:docs")
+	if !strings.Contains(out, "! [remote rejected] HEAD -> main (hook declined)") ||
+		!strings.Contains(out, "HEAD -> docs") || !e.uploaded(out, "repo") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// The full bundle that consolidated the push of docs is authorized
+	// against its parent rather than against the last bundle that was seen
+	// by the first repository.
+	e.git("a", "fetch", "origin")
+	if e.revParse("a", "refs/remotes/origin/main") != e.revParse("c", "HEAD") ||
+		e.revParse("a", "refs/remotes/origin/docs") != e.revParse("b", "HEAD") {
+		t.Fatal("unexpected refs")
+	}
+}
+
+func TestForgedManifest(t *testing.T) {
+	e := newTestEnv(t)
+	bob := e.genkey("bob")
+
+	pubKey, err := asymmetric.ReadPublicKey(e.path("key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "--add", "bundle.origin.authorize", pubKey.Fingerprint()+" refs/heads/*")
+	e.git("", "config", "--global", "--add", "bundle.origin.authorize", bob+" refs/heads/feature/*")
+	e.git("", "config", "--global", "bundle.origin.signerChange", "warn")
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	old := e.revParse("a", "HEAD")
+	e.git("a", "push", "origin", "main")
+	e.commit("a", "a")
+	e.git("a", "push", "origin", "main")
+	main := e.revParse("a", "HEAD")
+
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-v"), e.url("repo"), "v")
+
+	// Bob may only push feature branches, but the manifest of his push is
+	// forged to move main back and to claim a far newer version.
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-b"), e.url("repo"), "b")
+	e.git("b", "config", "bundle.privKey", e.path("bob.priv"))
+	e.commit("b", "b")
+	e.git("b", "push", "origin", "HEAD:feature/b")
+	e.resealManifest("repo", "bob", func(manifest map[string]interface{}) {
+		manifest["Refs"].(map[string]interface{})["refs/heads/main"] = old
+		manifest["Version"] = 1000
+	})
+
+	for _, version := range []string{"0", "2"} {
+		e.git("v", "-c", "protocol.version="+version, "fetch", "origin")
+		if e.revParse("v", "refs/remotes/origin/main") != main ||
+			e.revParse("v", "refs/remotes/origin/feature/b") != e.revParse("b", "HEAD") {
+			t.Fatalf("protocol v%s: unexpected refs", version)
+		}
+	}
+
+	// The version in the forged manifest wasn't recorded.
+	e.commit("a", "c")
+	e.git("a", "push", "origin", "main")
+	e.git("v", "fetch", "origin")
+	if e.revParse("v", "refs/remotes/origin/main") != e.revParse("a", "HEAD") {
+		t.Fatal("unexpected refs")
+	}
+}
+
+func TestRevokedBackdated(t *testing.T) {
+	e := newTestEnv(t)
+	bob := e.genkey("bob")
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "bundle.origin.signerChange", "warn")
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	e.git("a", "push", "origin", "main")
+
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-b"), e.url("repo"), "b")
+	e.git("b", "config", "bundle.privKey", e.path("bob.priv"))
+	e.commit("b", "b")
+	e.git("b", "push", "origin", "main")
+
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-v"), e.url("repo"), "v")
+	e.git("v", "config", "bundle.revocations", e.path("revocations"))
+
+	// The blobs from bob claim to be from before the revocation, as if he
+	// had backdated them.
+	revoked := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	e.helper("v", "revoke", "--time", revoked, bob)
+
+	// The version that was verified before the revocation is still
+	// accepted.
+	e.git("v", "fetch", "origin")
+
+	e.commit("b", "c")
+	e.git("b", "push", "origin", "main")
+	out := e.gitFail("v", "fetch", "origin")
+	if !strings.Contains(out, "the key has been revoked") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
+
+func TestRevokers(t *testing.T) {
+	e := newTestEnv(t)
+	bob := e.genkey("bob")
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "bundle.origin.signerChange", "warn")
+
+	pubKey, err := asymmetric.ReadPublicKey(e.path("key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	e.git("a", "push", "origin", "main")
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-v"), e.url("repo"), "v")
+
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-b"), e.url("repo"), "b")
+	e.git("b", "config", "bundle.privKey", e.path("bob.priv"))
+	e.git("b", "config", "bundle.revocations", e.path("revocations-b"))
+	e.helper("b", "revoke", "--publish", "origin", pubKey.Fingerprint())
+
+	// Bob may only revoke his own key.
+	e.commit("a", "a")
+	e.git("a", "push", "origin", "main")
+	out := e.git("v", "fetch", "origin")
+	if !strings.Contains(out, "ignoring the revocation of "+pubKey.Fingerprint()) ||
+		e.revParse("v", "refs/remotes/origin/main") != e.revParse("a", "HEAD") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.git("v", "config", "bundle.origin.revokers", bob)
+	e.commit("a", "b")
+	e.git("a", "push", "origin", "main")
+	out = e.gitFail("v", "fetch", "origin")
+	if !strings.Contains(out, "the key has been revoked") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
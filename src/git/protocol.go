@@ -0,0 +1,328 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// A protocol v2 session for `git upload-pack`.
+//
+// Protocol v2 is spoken on `connect` if the client asks for it (see
+// RequestedProtocolVersion).  `stateless-connect` isn't supported because Git
+// always prefers `connect` when a helper supports both, and `connect` is
+// needed for pushes.
+//
+// The capabilities are advertised by us and `ls-refs` is answered from the
+// manifest when the remote has an up-to-date one, so the bundles are only
+// downloaded once the client asks for objects.  `fetch` is handed to `git
+// upload-pack --stateless-rpc` in the verified mirror, with partial clone
+// filters enabled.
+type session struct {
+	r          *remote
+	candidates []*candidate
+	tmpDir     string
+
+	// Advertised chain and the objects that its annotated tags point to.
+	chain  *Chain
+	peeled map[string]string
+
+	// Manifest that the chain is advertised from, if any.
+	manifest *Manifest
+
+	// Verified mirror of the advertised chain.  Nil until the client asks
+	// for objects if the refs are advertised from a manifest.
+	mirror *Mirror
+}
+
+// Capabilities advertised on behalf of `git upload-pack` in protocol v2.
+var uploadPackV2Capabilities = []string{
+	"ls-refs=unborn",
+	"fetch=shallow filter",
+}
+
+// A protocol v2 request.
+type request struct {
+	command string
+	args    []string
+
+	// The request as it was received.
+	raw *bytes.Buffer
+}
+
+var ErrUnsupportedCommand = errors.New("unsupported protocol v2 command")
+
+// Serve `git upload-pack` with protocol v2 until the client ends the session.
+func serveProtocolV2(r *remote) (err error) {
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+
+	s := &session{r: r, candidates: candidates, tmpDir: tmpDir}
+	best := candidates[0]
+	if best.manifest != nil {
+		_, err := verifyState(r.statePath(), best.chain)
+		if err != nil {
+			return err
+		}
+
+		s.chain = best.chain
+		s.peeled = best.manifest.Peeled
+		s.manifest = best.manifest
+	} else {
+		err := s.sync(candidates)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkFreeze(s.chain)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.WriteString("\n")
+	if err != nil {
+		return err
+	}
+
+	err = s.advertise(os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	for {
+		req, err := readRequest(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		if req == nil {
+			return nil
+		}
+
+		log.Debugf("protocol v2 command: %s", req.command)
+		switch req.command {
+		case "ls-refs":
+			err = s.lsRefs(os.Stdout, req)
+		case "fetch":
+			err = s.fetch(req)
+		default:
+			err = errors.Wrap(ErrUnsupportedCommand, req.command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write the protocol v2 capability advertisement to `w`.
+func (s *session) advertise(w io.Writer) error {
+	caps := append([]string{"version 2", fmt.Sprintf("agent=%s/%s", metadata.Name(), metadata.Version())},
+		uploadPackV2Capabilities...)
+	format := s.chain.ObjectFormat
+	if format == "" {
+		format = "sha1"
+	}
+	caps = append(caps, "object-format="+format)
+
+	for _, line := range caps {
+		err := writePacket(w, []byte(line+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFlush(w)
+}
+
+// Answer an `ls-refs` request with the advertised refs.
+//
+// Only the refs that start with one of the `ref-prefix` arguments are
+// listed if there are any.  HEAD is listed first, as by `git upload-pack`.
+func (s *session) lsRefs(w io.Writer, req *request) error {
+	symrefs := false
+	peel := false
+	unborn := false
+	prefixes := []string{}
+
+	for _, arg := range req.args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	match := func(ref string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(ref, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lines := []string{}
+	if s.chain.Head != "" && match("HEAD") {
+		oid, ok := s.chain.Refs[s.chain.Head]
+		if !ok && unborn {
+			oid = "unborn"
+		}
+
+		if oid != "" {
+			line := oid + " HEAD"
+			if symrefs || oid == "unborn" {
+				line += " symref-target:" + s.chain.Head
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	for _, ref := range sortedRefs(s.chain.Refs) {
+		if !match(ref) {
+			continue
+		}
+
+		line := s.chain.Refs[ref] + " " + ref
+		if oid, ok := s.peeled[ref]; ok && peel {
+			line += " peeled:" + oid
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line := range lines {
+		err := writePacket(w, []byte(line+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFlush(w)
+}
+
+// Answer a `fetch` request from the verified mirror.
+func (s *session) fetch(req *request) error {
+	if s.mirror == nil {
+		// Only the URLs with the advertised refs can serve the
+		// request.
+		sources := []*candidate{}
+		for _, c := range s.candidates {
+			if c.manifest != nil && c.manifest.Tip == s.chain.Tip {
+				sources = append(sources, c)
+			}
+		}
+
+		err := s.sync(sources)
+		if err != nil {
+			return err
+		}
+
+		err = s.manifest.verify(s.chain, s.peeled)
+		if err != nil {
+			return err
+		}
+	}
+
+	uploadPack := exec.Command("git", "-c", "uploadpack.allowFilter=true", "upload-pack", "--stateless-rpc",
+		s.mirror.Path)
+	uploadPack.Env = append(os.Environ(), "GIT_PROTOCOL=version=2")
+	uploadPack.Stdin = req.raw
+	uploadPack.Stdout = os.Stdout
+	uploadPack.Stderr = os.Stderr
+	return uploadPack.Run()
+}
+
+// Bring the mirror up to date with the first of `candidates` that can be
+// verified.
+func (s *session) sync(candidates []*candidate) error {
+	mirror, chain, err := syncCandidates(s.r, candidates, false, s.tmpDir)
+	if err != nil {
+		return err
+	}
+
+	peeled, err := peeledRefs(mirror.Path, chain.Refs)
+	if err != nil {
+		return err
+	}
+
+	s.peeled = peeled
+	s.mirror = mirror
+	s.chain = chain
+	return nil
+}
+
+// Read a protocol v2 request from `r`.
+//
+// Nil is returned when the client ends the session, either with a flush-pkt
+// in place of a request or by closing the connection.
+func readRequest(r io.Reader) (*request, error) {
+	req := &request{raw: &bytes.Buffer{}}
+	args := false
+
+	for {
+		pkt, err := readPacket(r)
+		switch {
+		case errors.Is(err, io.EOF) && req.raw.Len() == 0:
+			return nil, nil
+		case errors.Is(err, errDelimPacket):
+			args = true
+			err = writeDelim(req.raw)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		if pkt == nil {
+			if req.raw.Len() == 0 {
+				return nil, nil
+			}
+
+			if req.command == "" {
+				return nil, errors.Wrap(ErrInvalidPacket, "request without a command")
+			}
+			return req, writeFlush(req.raw)
+		}
+
+		err = writePacket(req.raw, pkt)
+		if err != nil {
+			return nil, err
+		}
+
+		line := strings.TrimSuffix(string(pkt), "\n")
+		if args {
+			req.args = append(req.args, line)
+		} else if strings.HasPrefix(line, "command=") {
+			req.command = strings.TrimPrefix(line, "command=")
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package git
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The kind of bundle that is pushed by pushBundle.
+type pushMode int
+
+const (
+	// An incremental bundle on top of the current chain, or a full bundle
+	// if the chain is due to be consolidated.
+	pushAuto pushMode = iota
+
+	// A full bundle.  The current chain is kept as a generation.
+	pushFull
+
+	// A full bundle that replaces the current chain without keeping it as a
+	// generation, because the current chain is sealed for recipients that
+	// may have been removed from the keyring.
+	pushRekey
+)
+
+// Seal the refs in `refs` from the repository in `repo` together with `head`
+// as the next bundle after `chain` and upload it to the remote.
+//
+// The bundle is an incremental bundle on top of `chain` unless the chain is
+// due to be consolidated or `mode` asks for a full bundle.  The mirror is
+// updated with the refs in `repo` once the bundle has been uploaded.  The
+// pushed chain is returned.
+func pushBundle(r *remote, candidates []*candidate, mirror *Mirror, tmp string, chain *Chain, repo string,
+	refs map[string]string, head string, mode pushMode) (_ *Chain, err error) {
+	consolidate, err := Consolidate()
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := objectFormat(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	oldRefs := map[string]string{}
+	if chain != nil {
+		oldRefs = chain.Refs
+	}
+
+	tmpPath := filepath.Join(tmp, "plaintext")
+	hdr := &Header{
+		Version:      1,
+		Timestamp:    time.Now().Unix(),
+		ObjectFormat: format,
+		Head:         head,
+		Refs:         refs,
+		Updates:      refUpdates(oldRefs, refs),
+	}
+	if chain != nil {
+		hdr.Repository = chain.Repository
+		hdr.Version = chain.Version + 1
+		hdr.Parent = chain.Tip
+
+		if mode == pushAuto && chain.Length < consolidate && len(chain.Refs) > 0 {
+			err := createBundle(repo, tmpPath, refs, refObjects(chain.Refs))
+			if err == nil {
+				hdr.Index = chain.Length + 1
+				hdr.Base = chain.Base
+			} else if !errors.Is(err, ErrEmptyBundle) {
+				return nil, err
+			}
+		}
+	}
+
+	// Remotes that were created by older versions get an
+	// identifier on their next full bundle.
+	if hdr.Repository == "" && hdr.Index == 0 {
+		hdr.Repository, err = newRepositoryID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sealedFile := r.bundleFile
+	if hdr.Index > 0 {
+		r.progressf("creating incremental bundle %d on top of %s", hdr.Index, hdr.Base)
+
+		sealedFile, err = incrementalFile(r.bundleFile, hdr.Index)
+		if err != nil {
+			return nil, err
+		}
+		defer errorx.Defer(sealedFile.Close, &err)
+	} else {
+		r.progressf("creating full bundle")
+
+		err = createBundle(repo, tmpPath, refs, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := r.recipients()
+	if err != nil {
+		return nil, err
+	}
+
+	err = sealBundle(sealedFile, hdr, tmpPath, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := blob.NewReader(sealedFile, &blob.Options{
+		Type:      metadata.Name(),
+		Keyring:   r.keys,
+		Encrypted: Encrypt(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Other clients would reject a bundle that changes refs that we're not
+	// allowed to change.
+	err = r.policy.authorize(sealed.Signer.Fingerprint(), oldRefs, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sealed.Metadata.Hashes.SHA256
+	pushed := &Chain{
+		Repository:   hdr.Repository,
+		Base:         hash,
+		Tip:          hash,
+		Signer:       sealed.Signer.Fingerprint(),
+		Length:       hdr.Index,
+		Version:      hdr.Version,
+		Timestamp:    hdr.Timestamp,
+		Head:         head,
+		Refs:         refs,
+		ObjectFormat: format,
+	}
+	if hdr.Index > 0 {
+		pushed.Base = hdr.Base
+	}
+
+	record, err := createRecord(r, tmp, chain, hdr, pushed, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer errorx.Defer(record.Close, &err)
+
+	err = uploadBundle(r, candidates, repo, chain, hdr, sealedFile, record, pushed, mode != pushRekey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeState(r.statePath(), &State{
+		Repository: hdr.Repository,
+		Version:    hdr.Version,
+		Timestamp:  hdr.Timestamp,
+		Hash:       hash,
+		Base:       pushed.Base,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.cache.Record(r.uris[0], hash, pushed.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.approveSigner(pushed.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mirror.invalidate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyBundle(repo, mirror.Path, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setHead(mirror.Path, head, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mirror.save(pushed.Base, pushed.Tip, pushed.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	return pushed, writeChain(r.chainPath(), pushed)
+}
+
+// Select the ref that HEAD should point to after a push.
+//
+// The current HEAD of the remote is kept as long as it exists.  Otherwise,
+// HEAD in the workspace in `repo`, `main`, `master` or the first branch is
+// used, in that order.
+func defaultHead(chain *Chain, refs map[string]string, repo string) (string, error) {
+	workspace, err := headRef(repo)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{workspace, "refs/heads/main", "refs/heads/master"}
+	if chain != nil {
+		candidates = append([]string{chain.Head}, candidates...)
+	}
+
+	for _, ref := range candidates {
+		if _, ok := refs[ref]; ok {
+			return ref, nil
+		}
+	}
+
+	for _, ref := range sortedRefs(refs) {
+		if strings.HasPrefix(ref, "refs/heads/") {
+			return ref, nil
+		}
+	}
+
+	return "", nil
+}
+
+var ErrInvalidHead = errors.New("HEAD must point to a ref in the remote")
+
+// Point HEAD in the remote at `ref` by pushing a new bundle.
+func SetHead(name string, uris []*url.URL, cacheDir string, ref string) (err error) {
+	r, err := openRemote(name, uris, cacheDir)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(r.close, &err)
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+
+	mirror, chain, err := syncCandidates(r, candidates, false, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/heads/" + ref
+	}
+
+	if _, ok := chain.Refs[ref]; !ok {
+		return errors.Wrap(ErrInvalidHead, ref)
+	}
+
+	if chain.Head == ref {
+		log.Infof("HEAD already points to %s", ref)
+		return nil
+	}
+
+	repo, err := mirror.workspace(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("pointing HEAD at %s", ref)
+	_, err = pushBundle(r, candidates, mirror, tmpDir, chain, repo, chain.Refs, ref, pushAuto)
+	return err
+}
+
+// Re-seal the repository in a remote for the current keyring.
+//
+// The refs are pushed as a new full bundle even though they haven't changed,
+// so the remote is encrypted for the current recipients and signed by the
+// current key.  The previous chain isn't kept as a generation, because that
+// would copy blobs that are sealed for the previous recipients.
+//
+// Older blobs (incremental bundles from the previous chain, push records and
+// generations) are left on the remote because the transports can't remove
+// files.  They're ignored by readers, but they remain readable by the
+// recipients that they were sealed for, so they're listed for the user to
+// remove from the storage.
+func Rekey(name string, uris []*url.URL, cacheDir string) (err error) {
+	r, err := openRemote(name, uris, cacheDir)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(r.close, &err)
+
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	candidates, err := probeURLs(r)
+	if err != nil {
+		return err
+	}
+
+	mirror, chain, err := syncCandidates(r, candidates, false, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mirror.workspace(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("re-sealing version %d of %s", chain.Version, name)
+	pushed, err := pushBundle(r, candidates, mirror, tmpDir, chain, repo, chain.Refs, chain.Head, pushRekey)
+	if err != nil {
+		return err
+	}
+
+	if !Encrypt() {
+		return nil
+	}
+
+	for _, uri := range r.uris {
+		blobs, err := sealedBlobs(r, uri, pushed.Version)
+		if err != nil {
+			return err
+		}
+
+		for _, stale := range blobs {
+			log.Warnf("%s is sealed for the previous keyring; remove it from the storage to revoke "+
+				"access to it", stale)
+		}
+	}
+
+	return nil
+}
+
+// Retrieve the blobs at `uri` that were sealed before the full bundle with
+// version `version` replaced the chain: the incremental bundles of the
+// previous chain, the push records of older versions and the generations.
+func sealedBlobs(r *remote, uri *url.URL, version uint64) ([]*url.URL, error) {
+	generations, err := Generations()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := existingChain(r, uri, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for v := uint64(1); v < version; v++ {
+		rec := recordURL(uri, v)
+		hash, err := r.remoteHash(rec)
+		if err != nil {
+			return nil, err
+		}
+
+		if hash != "" {
+			blobs = append(blobs, rec)
+		}
+	}
+
+	// Generations are checked up to `bundle.generations` even if some are
+	// missing, because the setting may have changed since they were
+	// rotated.
+	for gen := 1; ; gen++ {
+		chain, err := existingChain(r, generationURL(uri, gen), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(chain) == 0 && gen > generations {
+			return blobs, nil
+		}
+		blobs = append(blobs, chain...)
+	}
+}
+
+// Retrieve the full bundle at `uri` and its incremental bundles that exist,
+// starting with the bundle at `index`.
+func existingChain(r *remote, uri *url.URL, index int) ([]*url.URL, error) {
+	blobs := []*url.URL{}
+	for ; ; index++ {
+		cur := uri
+		if index > 0 {
+			cur = incrementalURL(uri, index)
+		}
+
+		hash, err := r.remoteHash(cur)
+		if err != nil {
+			return nil, err
+		}
+
+		if hash == "" {
+			return blobs, nil
+		}
+		blobs = append(blobs, cur)
+	}
+}
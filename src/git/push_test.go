@@ -0,0 +1,81 @@
+package git
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultHead(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo")
+	out, err := exec.Command("git", "init", "--quiet", "--bare", repo).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v", out, err)
+	}
+
+	out, err = exec.Command("git", "--git-dir", repo, "symbolic-ref", "HEAD", "refs/heads/dev").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v", out, err)
+	}
+
+	tests := []struct {
+		name     string
+		chain    *Chain
+		refs     map[string]string
+		expected string
+	}{
+		{
+			name:     "current head",
+			chain:    &Chain{Head: "refs/heads/stable"},
+			refs:     map[string]string{"refs/heads/stable": "1", "refs/heads/dev": "2", "refs/heads/main": "3"},
+			expected: "refs/heads/stable",
+		},
+		{
+			name:     "deleted head",
+			chain:    &Chain{Head: "refs/heads/stable"},
+			refs:     map[string]string{"refs/heads/dev": "2", "refs/heads/main": "3"},
+			expected: "refs/heads/dev",
+		},
+		{
+			name:     "workspace head",
+			chain:    nil,
+			refs:     map[string]string{"refs/heads/dev": "2", "refs/heads/main": "3"},
+			expected: "refs/heads/dev",
+		},
+		{
+			name:     "main",
+			chain:    nil,
+			refs:     map[string]string{"refs/heads/master": "2", "refs/heads/main": "3"},
+			expected: "refs/heads/main",
+		},
+		{
+			name:     "master",
+			chain:    nil,
+			refs:     map[string]string{"refs/heads/master": "2", "refs/heads/a": "3"},
+			expected: "refs/heads/master",
+		},
+		{
+			name:     "first branch",
+			chain:    nil,
+			refs:     map[string]string{"refs/tags/a": "1", "refs/heads/c": "2", "refs/heads/b": "3"},
+			expected: "refs/heads/b",
+		},
+		{
+			name:     "no branches",
+			chain:    nil,
+			refs:     map[string]string{"refs/tags/a": "1"},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		head, err := defaultHead(test.chain, test.refs, repo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if head != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.name, test.expected, head)
+		}
+	}
+}
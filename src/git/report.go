@@ -0,0 +1,127 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/illikainen/go-utils/src/seq"
+	"github.com/pkg/errors"
+)
+
+// The report-status of `git receive-pack`.
+//
+// `git receive-pack` runs in a temporary repository, so the refs that it
+// reports as updated aren't on the remote until they've been sealed and
+// uploaded.  The report is therefore held back until the upload is done, and
+// every accepted ref is reported as rejected if the upload fails.  Otherwise,
+// Git would update its tracking refs for a push that never reached the
+// remote.
+//
+// The side-band capabilities are removed from the advertisement so that the
+// report is sent as plain pkt-lines, and `report-status-v2` is removed so that
+// there are no options to rewrite for rejected refs.
+type report struct {
+	lines []string
+}
+
+// Capabilities of `git receive-pack` that aren't advertised to the client.
+var hiddenCapabilities = []string{"side-band", "side-band-64k", "report-status-v2"}
+
+// Copy the ref advertisement of `git receive-pack` from `r` to `w` without the
+// capabilities in `hiddenCapabilities`.
+func relayAdvertisement(r io.Reader, w io.Writer) error {
+	for {
+		pkt, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+
+		if pkt == nil {
+			return writeFlush(w)
+		}
+
+		if refs, caps, ok := bytes.Cut(pkt, []byte{0}); ok {
+			kept := []string{}
+			for _, capability := range strings.Fields(string(caps)) {
+				name, _, _ := strings.Cut(capability, "=")
+				if !seq.Contains(hiddenCapabilities, name) {
+					kept = append(kept, capability)
+				}
+			}
+
+			pkt = []byte(string(refs) + "\x00" + strings.Join(kept, " ") + "\n")
+		}
+
+		err = writePacket(w, pkt)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read the report-status from `r`.
+//
+// Nil is returned if `git receive-pack` exits without a report, which is the
+// case when the client has nothing to push.
+func readReport(r io.Reader) (*report, error) {
+	rep := &report{}
+	for {
+		pkt, err := readPacket(r)
+		if errors.Is(err, io.EOF) && len(rep.lines) == 0 {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if pkt == nil {
+			break
+		}
+
+		rep.lines = append(rep.lines, strings.TrimSuffix(string(pkt), "\n"))
+	}
+
+	if len(rep.lines) == 0 || !strings.HasPrefix(rep.lines[0], "unpack ") {
+		return nil, errors.Wrap(ErrInvalidPacket, "missing unpack status")
+	}
+
+	return rep, nil
+}
+
+// Whether `git receive-pack` accepted any refs.
+func (rep *report) accepted() bool {
+	for _, line := range rep.lines {
+		if strings.HasPrefix(line, "ok ") {
+			return true
+		}
+	}
+	return false
+}
+
+// Report every accepted ref as rejected because of `err`.
+func (rep *report) reject(err error) {
+	reason := err.Error()
+	if errors.Is(err, ErrConcurrentUpdate) {
+		reason = "fetch first"
+	}
+	reason = strings.Join(strings.Fields(reason), " ")
+
+	for i, line := range rep.lines {
+		if strings.HasPrefix(line, "ok ") {
+			rep.lines[i] = "ng " + strings.TrimPrefix(line, "ok ") + " " + reason
+		}
+	}
+}
+
+func (rep *report) write(w io.Writer) error {
+	for _, line := range rep.lines {
+		err := writePacket(w, []byte(line+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFlush(w)
+}
@@ -0,0 +1,112 @@
+package git
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func packets(lines ...string) string {
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		if line == "" {
+			_ = writeFlush(buf)
+		} else {
+			_ = writePacket(buf, []byte(line))
+		}
+	}
+	return buf.String()
+}
+
+func TestRelayAdvertisement(t *testing.T) {
+	oid := strings.Repeat("1", 40)
+	input := packets(
+		oid+" refs/heads/main\x00report-status report-status-v2 delete-refs side-band-64k quiet "+
+			"atomic ofs-delta object-format=sha1 agent=git/2\n",
+		oid+" refs/tags/v1\n",
+		"",
+		"trailing data",
+	)
+
+	out := &bytes.Buffer{}
+	r := strings.NewReader(input)
+	err := relayAdvertisement(r, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := packets(
+		oid+" refs/heads/main\x00report-status delete-refs quiet atomic ofs-delta object-format=sha1 "+
+			"agent=git/2\n",
+		oid+" refs/tags/v1\n",
+		"",
+	)
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+
+	if r.Len() != len(packets("trailing data")) {
+		t.Error("read past the advertisement")
+	}
+}
+
+func TestReport(t *testing.T) {
+	rep, err := readReport(strings.NewReader(""))
+	if err != nil || rep != nil {
+		t.Fatalf("expected no report, got %v, %v", rep, err)
+	}
+
+	_, err = readReport(strings.NewReader(packets("ok refs/heads/main\n", "")))
+	if !errors.Is(err, ErrInvalidPacket) {
+		t.Fatalf("expected %v, got %v", ErrInvalidPacket, err)
+	}
+
+	input := packets("unpack ok\n", "ok refs/heads/main\n", "ng refs/heads/x hook declined\n", "")
+	rep, err = readReport(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rep.accepted() {
+		t.Fatal("expected accepted refs")
+	}
+
+	out := &bytes.Buffer{}
+	err = rep.write(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != input {
+		t.Fatalf("expected %q, got %q", input, out.String())
+	}
+
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{errors.Wrap(ErrConcurrentUpdate, "x changed"), "fetch first"},
+		{errors.New("unable to\nupload"), "unable to upload"},
+	}
+
+	for _, test := range tests {
+		rep, err := readReport(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep.reject(test.err)
+
+		if rep.accepted() {
+			t.Errorf("%v: accepted refs after rejecting", test.err)
+		}
+
+		expected := []string{"unpack ok", "ng refs/heads/main " + test.reason, "ng refs/heads/x hook declined"}
+		for i, line := range rep.lines {
+			if line != expected[i] {
+				t.Errorf("%v: expected %q, got %q", test.err, expected[i], line)
+			}
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-netutils/src/transport"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/illikainen/go-utils/src/iofs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Revocations is a list of keys that are no longer trusted.
+//
+// The list is stored as a signed (but not encrypted) blob in the file in
+// `bundle.revocations` and optionally next to the bundles of a remote in
+// `<url>.revocations`.  The lists are merged, and the lists that are downloaded
+// from a remote are remembered in the cache directory, so a revocation can't be
+// undone by removing it from a remote.  A list from a remote may only revoke
+// its own signer unless the signer is one of `bundle.<remote>.revokers`, so
+// that a key can't lock the other keys out of a remote.
+//
+// Blobs that are signed by a revoked key at or after the revocation time are
+// rejected, and revoked keys are excluded as recipients of pushed bundles.
+// The time of a blob is asserted by its signer, so blobs from a revoked key
+// are also rejected if they describe a version that hasn't been verified
+// before (see checkRevoked).
+type Revocations struct {
+	Format int
+	Keys   []*Revocation
+}
+
+type Revocation struct {
+	Fingerprint string
+	Time        int64
+	Reason      string
+}
+
+const RevocationsFormat = 1
+
+const revocationsMagic = "# git-remote-bundle revocations v1\n"
+
+var ErrInvalidRevocations = errors.New("invalid revocation list")
+
+var ErrRevoked = errors.New("the key has been revoked")
+
+func revocationsURL(uri *url.URL) *url.URL {
+	rev := *uri
+	rev.Path = uri.Path + ".revocations"
+	rev.RawPath = ""
+	return &rev
+}
+
+func revocationsOptions(keys *blob.Keyring) *blob.Options {
+	return &blob.Options{
+		Type:      metadata.Name() + "-revocations",
+		Keyring:   keys,
+		Encrypted: false,
+	}
+}
+
+// Retrieve the revocation of `fingerprint` that applies to a blob from
+// `timestamp`, if any.
+func (rev *Revocations) revoked(fingerprint string, timestamp int64) *Revocation {
+	if rev == nil {
+		return nil
+	}
+
+	for _, key := range rev.Keys {
+		if key.Fingerprint == fingerprint && timestamp >= key.Time {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// Retrieve the revocation of `fingerprint` regardless of its time, if any.
+func (rev *Revocations) find(fingerprint string) *Revocation {
+	return rev.revoked(fingerprint, math.MaxInt64)
+}
+
+// Retrieve the revocations in a list signed by `signer` that it's allowed to
+// make.  Every revocation is kept if the signer is one of `revokers`, and
+// otherwise only the revocation of the signer itself.
+func (rev *Revocations) signedBy(signer string, revokers []string) *Revocations {
+	for _, revoker := range revokers {
+		if revoker == signer {
+			return rev
+		}
+	}
+
+	allowed := &Revocations{Format: rev.Format}
+	for _, key := range rev.Keys {
+		if key.Fingerprint == signer {
+			allowed.Keys = append(allowed.Keys, key)
+		} else {
+			log.Warnf("ignoring the revocation of %s by %s", key.Fingerprint, signer)
+		}
+	}
+
+	return allowed
+}
+
+// Add the revocations in `other` to the list.
+//
+// A key that is revoked in both lists keeps the earliest revocation time.
+// True is returned if the list changed.
+func (rev *Revocations) merge(other *Revocations) bool {
+	changed := false
+	for _, key := range other.Keys {
+		found := false
+		for _, cur := range rev.Keys {
+			if cur.Fingerprint == key.Fingerprint {
+				found = true
+				if key.Time < cur.Time {
+					cur.Time = key.Time
+					cur.Reason = key.Reason
+					changed = true
+				}
+			}
+		}
+
+		if !found {
+			rev.Keys = append(rev.Keys, &Revocation{
+				Fingerprint: key.Fingerprint,
+				Time:        key.Time,
+				Reason:      key.Reason,
+			})
+			changed = true
+		}
+	}
+
+	sort.Slice(rev.Keys, func(i, j int) bool {
+		return rev.Keys[i].Fingerprint < rev.Keys[j].Fingerprint
+	})
+	return changed
+}
+
+// Read the verified revocation list in the sealed blob at `path`.  An empty
+// list is returned if the file doesn't exist.
+func readRevocations(path string, keys *blob.Keyring) (rev *Revocations, err error) {
+	f, err := os.Open(path) // #nosec G304
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Revocations{Format: RevocationsFormat}, nil
+		}
+		return nil, err
+	}
+	defer errorx.Defer(f.Close, &err)
+
+	sealed, err := blob.NewReader(f, revocationsOptions(keys))
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	return parseRevocations(sealed)
+}
+
+func parseRevocations(sealed *blob.Reader) (*Revocations, error) {
+	_, err := iofs.Seek(sealed, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(revocationsMagic)) {
+		return nil, errors.Wrap(ErrInvalidRevocations, "missing magic")
+	}
+
+	rev := &Revocations{}
+	err = json.Unmarshal(data[len(revocationsMagic):], rev)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidRevocations, err.Error())
+	}
+
+	if rev.Format != RevocationsFormat {
+		return nil, errors.Wrapf(ErrInvalidRevocations, "unsupported format %d", rev.Format)
+	}
+
+	return rev, nil
+}
+
+// Seal `rev` and write the result to `path`.
+func writeRevocations(path string, rev *Revocations, keys *blob.Keyring) (err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp) // #nosec G304
+	if err != nil {
+		return err
+	}
+
+	err = sealRevocations(f, rev, keys)
+	err = errorx.Join(err, f.Close())
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func sealRevocations(f *os.File, rev *Revocations, keys *blob.Keyring) (err error) {
+	writer, err := blob.NewWriter(f, revocationsOptions(keys))
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(writer.Close, &err)
+
+	rev.Format = RevocationsFormat
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append([]byte(revocationsMagic), data...))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Sign()
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Read the revocations that apply to a remote from `bundle.revocations` and
+// from the lists that have previously been downloaded from the remote.
+func remoteRevocations(dir string, keys *blob.Keyring) (*Revocations, error) {
+	path, err := RevocationsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	rev := &Revocations{Format: RevocationsFormat}
+	if path != "" {
+		rev, err = readRevocations(path, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cached, err := readRevocations(filepath.Join(dir, "revocations"), keys)
+	if err != nil {
+		return nil, err
+	}
+	rev.merge(cached)
+
+	return rev, nil
+}
+
+// Merge the revocation list at `uri`, if any, into the revocations of the
+// remote.
+func (r *remote) fetchRevocations(uri *url.URL) (err error) {
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	f, err := os.Create(filepath.Join(tmpDir, "revocations")) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(f.Close, &err)
+
+	sealed, err := blob.Download(revocationsURL(uri), f, revocationsOptions(r.keys))
+	if err != nil {
+		if errors.Is(err, transport.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	rev, err := parseRevocations(sealed)
+	if err != nil {
+		return err
+	}
+
+	// A list that was signed by a revoked key isn't trusted, regardless of
+	// the time it claims to be from.
+	signer := sealed.Signer.Fingerprint()
+	if r.revoked.find(signer) != nil {
+		log.Warnf("ignoring the revocation list: %s: %s has been revoked", revocationsURL(uri), signer)
+		return nil
+	}
+
+	if !r.revoked.merge(rev.signedBy(signer, r.revokers)) {
+		return nil
+	}
+
+	log.Infof("%s: updated the revocation list", uri)
+	return writeRevocations(filepath.Join(r.dir, "revocations"), r.revoked, r.keys)
+}
+
+// Verify that the sealed blob in `sealed`, downloaded from `uri`, isn't signed
+// by a revoked key.
+//
+// A revoked key could backdate new blobs to before its revocation, so a blob
+// from a revoked key is only accepted if it describes a `version` of the
+// remote that was verified before (i.e., one that isn't newer than the last
+// verified state).
+func (r *remote) checkRevoked(uri *url.URL, sealed *blob.Reader, version uint64) error {
+	signer := sealed.Signer.Fingerprint()
+	key := r.revoked.revoked(signer, sealed.Metadata.Timestamp)
+	if key != nil {
+		return errors.Wrapf(ErrRevoked, "%s: %s was revoked at %s (%s)", uri, signer,
+			time.Unix(key.Time, 0).UTC(), key.Reason)
+	}
+
+	key = r.revoked.find(signer)
+	if key == nil {
+		return nil
+	}
+
+	state, err := readState(r.statePath())
+	if err != nil {
+		return err
+	}
+
+	if version > state.Version {
+		return errors.Wrapf(ErrRevoked, "%s: %s was revoked at %s (%s) and version %d is newer than the "+
+			"last verified version %d", uri, signer, time.Unix(key.Time, 0).UTC(), key.Reason, version,
+			state.Version)
+	}
+
+	return nil
+}
+
+// Retrieve the keyring without revoked keys for sealing new blobs.
+func (r *remote) recipients() (*blob.Keyring, error) {
+	now := time.Now().Unix()
+	if r.revoked.revoked(r.keys.Private.Fingerprint(), now) != nil {
+		return nil, errors.Wrapf(ErrRevoked, "%s", r.keys.Private.Fingerprint())
+	}
+
+	keys := &blob.Keyring{Private: r.keys.Private}
+	for _, key := range r.keys.Public {
+		if r.revoked.revoked(key.Fingerprint(), now) != nil {
+			log.Infof("excluding the revoked key %s", key)
+			continue
+		}
+		keys.Public = append(keys.Public, key)
+	}
+
+	return keys, nil
+}
+
+// Add the keys in `fingerprints` to the local revocation list as revoked since
+// `revoked`, and publish the list to the URLs in `publish` of the remote named
+// `name`.
+//
+// The revoked keys are listed if there's nothing to revoke or publish.
+func Revoke(fingerprints []string, revoked time.Time, reason string, name string, publish []*url.URL) error {
+	path, err := RevocationsPath()
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		return errors.Errorf("`bundle.revocations` isn't set")
+	}
+
+	keys, err := ReadKeyring()
+	if err != nil {
+		return err
+	}
+
+	if len(publish) > 0 {
+		keys, err = RemoteKeyring(name, publish[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	rev, err := readRevocations(path, keys)
+	if err != nil {
+		return err
+	}
+
+	if len(fingerprints) == 0 && len(publish) == 0 {
+		for _, key := range rev.Keys {
+			log.Infof("%s revoked at %s: %s", key.Fingerprint, time.Unix(key.Time, 0).UTC(), key.Reason)
+		}
+		return nil
+	}
+
+	for _, fingerprint := range fingerprints {
+		rev.merge(&Revocations{Keys: []*Revocation{{
+			Fingerprint: fingerprint,
+			Time:        revoked.Unix(),
+			Reason:      reason,
+		}}})
+		log.Infof("revoked %s at %s", fingerprint, revoked.UTC())
+	}
+
+	err = writeRevocations(path, rev, keys)
+	if err != nil {
+		return err
+	}
+
+	revokers, err := Revokers(name)
+	if err != nil {
+		return err
+	}
+
+	for _, uri := range publish {
+		err := publishRevocations(uri, path, keys, revokers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Merge the revocation list at `uri` with the local list in `path` and
+// upload the result.  Only the revocations at `uri` that its signer is
+// allowed to make according to `revokers` are kept.
+func publishRevocations(uri *url.URL, path string, keys *blob.Keyring, revokers []string) (err error) {
+	tmpDir, tmpCleanup, err := iofs.MkdirTemp()
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(tmpCleanup, &err)
+
+	rev, err := readRevocations(path, keys)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(tmpDir, "revocations")) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(f.Close, &err)
+
+	sealed, err := blob.Download(revocationsURL(uri), f, revocationsOptions(keys))
+	if err == nil {
+		remote, err := parseRevocations(sealed)
+		if err != nil {
+			return err
+		}
+		rev.merge(remote.signedBy(sealed.Signer.Fingerprint(), revokers))
+	} else if !errors.Is(err, transport.ErrNotExist) {
+		return err
+	}
+
+	_, err = iofs.Seek(f, 0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	err = sealRevocations(f, rev, keys)
+	if err != nil {
+		return err
+	}
+
+	return blob.Upload(revocationsURL(uri), f, revocationsOptions(keys))
+}
@@ -0,0 +1,141 @@
+package git
+
+import "testing"
+
+func TestRevoked(t *testing.T) {
+	rev := &Revocations{Keys: []*Revocation{
+		{Fingerprint: "a", Time: 100, Reason: "lost"},
+		{Fingerprint: "b", Time: 200, Reason: "compromised"},
+	}}
+
+	tests := []struct {
+		fingerprint string
+		timestamp   int64
+		revoked     bool
+	}{
+		{"a", 99, false},
+		{"a", 100, true},
+		{"a", 101, true},
+		{"b", 150, false},
+		{"b", 250, true},
+		{"c", 1000, false},
+	}
+
+	for _, test := range tests {
+		key := rev.revoked(test.fingerprint, test.timestamp)
+		if (key != nil) != test.revoked {
+			t.Errorf("%s at %d: expected revoked=%v, got %v", test.fingerprint, test.timestamp,
+				test.revoked, key)
+		}
+
+		if key != nil && key.Fingerprint != test.fingerprint {
+			t.Errorf("%s: got the revocation of %s", test.fingerprint, key.Fingerprint)
+		}
+	}
+
+	var empty *Revocations
+	if empty.revoked("a", 1000) != nil {
+		t.Error("a nil list revoked a key")
+	}
+}
+
+func TestMergeRevocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		cur      []*Revocation
+		other    []*Revocation
+		expected []*Revocation
+		changed  bool
+	}{
+		{
+			name:     "empty",
+			cur:      nil,
+			other:    nil,
+			expected: nil,
+			changed:  false,
+		},
+		{
+			name:     "new key",
+			cur:      []*Revocation{{Fingerprint: "b", Time: 200, Reason: "b"}},
+			other:    []*Revocation{{Fingerprint: "a", Time: 100, Reason: "a"}},
+			expected: []*Revocation{{"a", 100, "a"}, {"b", 200, "b"}},
+			changed:  true,
+		},
+		{
+			name:     "earlier time",
+			cur:      []*Revocation{{Fingerprint: "a", Time: 200, Reason: "late"}},
+			other:    []*Revocation{{Fingerprint: "a", Time: 100, Reason: "early"}},
+			expected: []*Revocation{{"a", 100, "early"}},
+			changed:  true,
+		},
+		{
+			name:     "later time",
+			cur:      []*Revocation{{Fingerprint: "a", Time: 100, Reason: "early"}},
+			other:    []*Revocation{{Fingerprint: "a", Time: 200, Reason: "late"}},
+			expected: []*Revocation{{"a", 100, "early"}},
+			changed:  false,
+		},
+		{
+			name:     "same",
+			cur:      []*Revocation{{Fingerprint: "a", Time: 100, Reason: "a"}},
+			other:    []*Revocation{{Fingerprint: "a", Time: 100, Reason: "other"}},
+			expected: []*Revocation{{"a", 100, "a"}},
+			changed:  false,
+		},
+	}
+
+	for _, test := range tests {
+		rev := &Revocations{Keys: test.cur}
+		changed := rev.merge(&Revocations{Keys: test.other})
+		if changed != test.changed {
+			t.Errorf("%s: expected changed=%v, got %v", test.name, test.changed, changed)
+		}
+
+		if len(rev.Keys) != len(test.expected) {
+			t.Errorf("%s: expected %d keys, got %d", test.name, len(test.expected), len(rev.Keys))
+			continue
+		}
+
+		for i, key := range rev.Keys {
+			if *key != *test.expected[i] {
+				t.Errorf("%s: expected %+v, got %+v", test.name, test.expected[i], key)
+			}
+		}
+	}
+}
+
+func TestRevocationsSignedBy(t *testing.T) {
+	rev := &Revocations{Keys: []*Revocation{
+		{Fingerprint: "a", Time: 100, Reason: "a"},
+		{Fingerprint: "b", Time: 200, Reason: "b"},
+	}}
+
+	tests := []struct {
+		signer   string
+		revokers []string
+		expected []string
+	}{
+		{"a", nil, []string{"a"}},
+		{"b", []string{"a"}, []string{"b"}},
+		{"a", []string{"a"}, []string{"a", "b"}},
+		{"c", []string{"a", "b"}, nil},
+	}
+
+	for _, test := range tests {
+		keys := []string{}
+		for _, key := range rev.signedBy(test.signer, test.revokers).Keys {
+			keys = append(keys, key.Fingerprint)
+		}
+
+		if len(keys) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.signer, test.expected, keys)
+			continue
+		}
+
+		for i := range keys {
+			if keys[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.signer, test.expected, keys)
+			}
+		}
+	}
+}
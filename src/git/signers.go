@@ -0,0 +1,191 @@
+package git
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signers are the keys that have published bundles to a remote.
+//
+// The signers of a remote are pinned the first time it's fetched.  Bundles
+// that are signed by another key in the keyring are rejected (or accepted with
+// a warning, depending on `bundle.<remote>.signerChange`) until the new key is
+// approved with the `approve` command.  This limits the damage that a single
+// compromised key in a large keyring can do to remotes that it has never
+// published to.
+type Signers struct {
+	// Time when each signer was approved.
+	Approved map[string]int64
+
+	// Time when each signer that hasn't been approved was first seen.
+	Pending map[string]int64
+}
+
+var ErrUnknownSigner = errors.New("the remote is signed by a key that hasn't published to it before")
+
+func readSigners(path string) (*Signers, error) {
+	data, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	signers := &Signers{}
+	err = json.Unmarshal(data, signers)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	if signers.Approved == nil {
+		signers.Approved = map[string]int64{}
+	}
+
+	if signers.Pending == nil {
+		signers.Pending = map[string]int64{}
+	}
+
+	return signers, nil
+}
+
+func writeSigners(path string, signers *Signers) error {
+	data, err := json.Marshal(signers)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Verify that `signer` has been approved to publish the blob at `uri`.
+//
+// Every signer that is seen before the signers of the remote have been pinned
+// is approved.
+func (r *remote) checkSigner(uri *url.URL, signer string) error {
+	signers, err := readSigners(r.signersPath())
+	if err != nil {
+		return err
+	}
+
+	if signers == nil || r.pinning {
+		if signers == nil {
+			signers = &Signers{Approved: map[string]int64{}, Pending: map[string]int64{}}
+		}
+
+		if _, ok := signers.Approved[signer]; ok {
+			return nil
+		}
+
+		log.Infof("pinning %s as a signer for %s", signer, r.name)
+		r.pinning = true
+		signers.Approved[signer] = time.Now().Unix()
+		return writeSigners(r.signersPath(), signers)
+	}
+
+	if _, ok := signers.Approved[signer]; ok {
+		return nil
+	}
+
+	if _, ok := signers.Pending[signer]; !ok {
+		signers.Pending[signer] = time.Now().Unix()
+		err := writeSigners(r.signersPath(), signers)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = errors.Wrapf(ErrUnknownSigner, "%s: %s (approve it with `%s approve %s %s`)", uri, signer,
+		metadata.Name(), r.name, signer)
+	if r.signerChange == "warn" {
+		log.Warnf("%v", err)
+		return nil
+	}
+
+	return err
+}
+
+// Approve `signer` to publish to the remote without a warning or an error.
+func (r *remote) approveSigner(signer string) error {
+	signers, err := readSigners(r.signersPath())
+	if err != nil {
+		return err
+	}
+
+	if signers == nil {
+		signers = &Signers{Approved: map[string]int64{}, Pending: map[string]int64{}}
+	}
+
+	if _, ok := signers.Approved[signer]; ok {
+		return nil
+	}
+
+	delete(signers.Pending, signer)
+	signers.Approved[signer] = time.Now().Unix()
+	return writeSigners(r.signersPath(), signers)
+}
+
+func (r *remote) signersPath() string {
+	return filepath.Join(r.dir, "signers.json")
+}
+
+// Approve the signers in `fingerprints` for a remote, or list the approved and
+// pending signers if `fingerprints` is empty.
+func ApproveSigners(name string, uris []*url.URL, cacheDir string, fingerprints []string) (err error) {
+	r, err := openRemote(name, uris, cacheDir)
+	if err != nil {
+		return err
+	}
+	defer errorx.Defer(r.close, &err)
+
+	for _, fingerprint := range fingerprints {
+		err := r.approveSigner(fingerprint)
+		if err != nil {
+			return err
+		}
+		log.Infof("approved %s as a signer for %s", fingerprint, name)
+	}
+
+	if len(fingerprints) > 0 {
+		return nil
+	}
+
+	signers, err := readSigners(r.signersPath())
+	if err != nil || signers == nil {
+		return err
+	}
+
+	for _, status := range []struct {
+		name    string
+		signers map[string]int64
+	}{{"approved", signers.Approved}, {"pending", signers.Pending}} {
+		fingerprints := []string{}
+		for fingerprint := range status.signers {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+		sort.Strings(fingerprints)
+
+		for _, fingerprint := range fingerprints {
+			log.Infof("%s: %s since %s", status.name, fingerprint,
+				time.Unix(status.signers[fingerprint], 0).UTC())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package git_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/illikainen/go-cryptor/src/asymmetric"
+)
+
+func TestSignerPinning(t *testing.T) {
+	e := newTestEnv(t)
+	bob := e.genkey("bob")
+	e.git("", "config", "--global", "--add", "bundle.pubKeys", e.path("bob.pub"))
+	e.git("", "config", "--global", "--unset", "bundle.cacheDir")
+
+	pubKey, err := asymmetric.ReadPublicKey(e.path("key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.initRepo("a", "repo")
+	e.git("a", "config", "bundle.cacheDir", e.path("cache-a"))
+	e.git("a", "push", "origin", "main")
+
+	// The signer of the remote is pinned on the first fetch.
+	out := e.git("", "clone", "--config", "bundle.cacheDir="+e.path("cache-v"), e.url("repo"), "v")
+	if !strings.Contains(out, "pinning "+pubKey.Fingerprint()) {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.git("", "clone", "--quiet", "--config", "bundle.cacheDir="+e.path("cache-b"), e.url("repo"), "b")
+	e.git("b", "config", "bundle.privKey", e.path("bob.priv"))
+	e.commit("b", "b")
+	e.git("b", "push", "origin", "main")
+
+	// Bob is in the keyring but hasn't published to the remote before.
+	out = e.gitFail("v", "fetch", "origin")
+	if !strings.Contains(out, "hasn't published to it before") ||
+		!strings.Contains(out, "approve origin "+bob) {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	out = e.helper("v", "approve", "origin")
+	if !strings.Contains(out, "approved: "+pubKey.Fingerprint()) || !strings.Contains(out, "pending: "+bob) {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// A warning is enough with `bundle.<remote>.signerChange`.
+	out = e.git("v", "-c", "bundle.origin.signerChange=warn", "ls-remote", "origin")
+	if !strings.Contains(out, "hasn't published to it before") || !strings.Contains(out, e.revParse("b", "HEAD")) {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	e.helper("v", "approve", "origin", bob)
+	out = e.git("v", "fetch", "origin")
+	if strings.Contains(out, "hasn't published to it before") ||
+		e.revParse("v", "refs/remotes/origin/main") != e.revParse("b", "HEAD") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
@@ -0,0 +1,218 @@
+package git
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// State is the last verified state of a remote.
+//
+// It's stored in the cache directory and used to refuse bundles that are older
+// than what has already been seen.  Otherwise, a malicious storage host could
+// serve an old (but validly signed) bundle to roll back the repository or to
+// hide newer pushes.
+type State struct {
+	Repository string
+	Version    uint64
+	Timestamp  int64
+	Hash       string
+	Base       string
+}
+
+var ErrRepositoryMismatch = errors.New("the remote contains another repository than the one pinned " +
+	"for it (remove the cached state to pin the new repository)")
+
+var ErrRollback = errors.New("the remote is older than the last seen version " +
+	"(set `bundle.allowRollback` to override)")
+
+var ErrFork = errors.New("the remote was replaced by another chain with the last seen version " +
+	"(set `bundle.allowRollback` to override)")
+
+var ErrFrozen = errors.New("the remote hasn't been pushed to within `bundle.maxAge` " +
+	"(newer pushes may be withheld by the storage host)")
+
+func readState(path string) (*State, error) {
+	data, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &State{}, nil
+		}
+		return nil, err
+	}
+
+	state := &State{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	return state, nil
+}
+
+func writeState(path string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Verify that `chain` is the repository pinned for the remote and that it
+// isn't older than the last seen state in `path`, and record it as the new
+// state.
+//
+// The repository is pinned the first time a remote is seen.  A chain with the
+// same version as the last seen state must also have the same tip, because
+// every push increments the version.  Another tip means that the remote was
+// forked, e.g. by a storage host that serves different chains to different
+// clients.
+//
+// A nil `chain` means that the remote doesn't exist.
+func checkState(path string, chain *Chain) error {
+	cur, err := verifyState(path, chain)
+	if err != nil {
+		return err
+	}
+
+	if chain == nil {
+		return nil
+	}
+
+	return writeState(path, cur)
+}
+
+// Verify `chain` like checkState without recording it, and return the state
+// that it would be recorded as.
+func verifyState(path string, chain *Chain) (*State, error) {
+	state, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := &State{}
+	if chain != nil {
+		cur = &State{
+			Repository: chain.Repository,
+			Version:    chain.Version,
+			Timestamp:  chain.Timestamp,
+			Hash:       chain.Tip,
+			Base:       chain.Base,
+		}
+		log.Infof("remote version %d from %s", cur.Version, time.Unix(cur.Timestamp, 0).UTC())
+
+		if state.Repository != "" && state.Repository != cur.Repository {
+			return nil, errors.Wrapf(ErrRepositoryMismatch, "'%s' != '%s'", cur.Repository,
+				state.Repository)
+		}
+	}
+
+	if cur.Version < state.Version {
+		allow, err := AllowRollback()
+		if err != nil {
+			return nil, err
+		}
+
+		if !allow {
+			return nil, errors.Wrapf(ErrRollback, "%d < %d", cur.Version, state.Version)
+		}
+		log.Warnf("accepting rollback from version %d to %d", state.Version, cur.Version)
+	} else if cur.Version == state.Version && state.Hash != "" && cur.Hash != state.Hash {
+		allow, err := AllowRollback()
+		if err != nil {
+			return nil, err
+		}
+
+		if !allow {
+			return nil, errors.Wrapf(ErrFork, "version %d is '%s' instead of '%s'", cur.Version,
+				cur.Hash, state.Hash)
+		}
+		log.Warnf("accepting fork of version %d", cur.Version)
+	}
+
+	return cur, nil
+}
+
+// Verify that `chain` was pushed within `bundle.maxAge`.
+//
+// The version counter stops a storage host from serving an older chain than
+// one that has been seen, but not from freezing the remote by serving the
+// last seen chain and withholding newer pushes.  A frozen remote can't be told
+// apart from one that nobody has pushed to, so the check is only done if it's
+// configured for remotes that are expected to be pushed to regularly.  Only
+// fetches are checked, because a push is what brings a stale remote up to date.
+func checkFreeze(chain *Chain) error {
+	maxAge, err := MaxAge()
+	if err != nil {
+		return err
+	}
+
+	if maxAge <= 0 || chain == nil {
+		return nil
+	}
+
+	pushed := time.Unix(chain.Timestamp, 0)
+	if time.Since(pushed) > maxAge {
+		return errors.Wrapf(ErrFrozen, "version %d is from %s", chain.Version, pushed.UTC())
+	}
+
+	return nil
+}
+
+// Verify the full bundle that starts `chain` against the last seen state in
+// `path` before the mirror is rebuilt from it.
+//
+// Only the full bundle has been verified at this point, so the version of the
+// whole chain isn't known yet.  However, a full bundle that replaces the last
+// seen chain gets a version that follows its tip, so a new full bundle that
+// isn't newer than the last seen state is a rollback.
+func checkBase(path string, chain *Chain) error {
+	state, err := readState(path)
+	if err != nil {
+		return err
+	}
+
+	if state.Repository != "" && state.Repository != chain.Repository {
+		return errors.Wrapf(ErrRepositoryMismatch, "'%s' != '%s'", chain.Repository, state.Repository)
+	}
+
+	// States that were recorded by older versions don't include the base.
+	if state.Base == "" || state.Base == chain.Base || chain.Version > state.Version {
+		return nil
+	}
+
+	allow, err := AllowRollback()
+	if err != nil {
+		return err
+	}
+
+	if !allow {
+		return errors.Wrapf(ErrRollback, "the full bundle with version %d doesn't follow %d",
+			chain.Version, state.Version)
+	}
+
+	return nil
+}
+
+// Generate a random identifier for a new repository.
+func newRepositoryID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
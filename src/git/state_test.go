@@ -0,0 +1,144 @@
+package git
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckState(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	steps := []struct {
+		name  string
+		chain *Chain
+		allow bool
+		err   error
+	}{
+		{"missing remote", nil, false, nil},
+		{"first version", &Chain{Repository: "r", Version: 2, Tip: "a"}, false, nil},
+		{"same version", &Chain{Repository: "r", Version: 2, Tip: "a"}, false, nil},
+		{"fork", &Chain{Repository: "r", Version: 2, Tip: "x"}, false, ErrFork},
+		{"rollback", &Chain{Repository: "r", Version: 1, Tip: "b"}, false, ErrRollback},
+		{"deleted remote", nil, false, ErrRollback},
+		{"other repository", &Chain{Repository: "s", Version: 3, Tip: "c"}, false, ErrRepositoryMismatch},
+		{"newer version", &Chain{Repository: "r", Version: 3, Tip: "d"}, false, nil},
+		{"allowed rollback", &Chain{Repository: "r", Version: 1, Tip: "e"}, true, nil},
+		{"after rollback", &Chain{Repository: "r", Version: 1, Tip: "e"}, false, nil},
+		{"allowed fork", &Chain{Repository: "r", Version: 1, Tip: "f"}, true, nil},
+	}
+
+	for _, step := range steps {
+		if step.allow {
+			t.Setenv("GIT_CONFIG_PARAMETERS", "'bundle.allowRollback'='true'")
+		} else {
+			t.Setenv("GIT_CONFIG_PARAMETERS", "")
+		}
+
+		err := checkState(path, step.chain)
+		if step.err == nil && err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if step.err != nil && !errors.Is(err, step.err) {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.err, err)
+		}
+	}
+
+	state, err := readState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Version != 1 || state.Hash != "f" {
+		t.Errorf("unexpected state: %+v", state)
+	}
+}
+
+func TestCheckFreeze(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+
+	now := time.Now()
+	tests := []struct {
+		config string
+		chain  *Chain
+		err    error
+	}{
+		{"", &Chain{Timestamp: now.AddDate(-1, 0, 0).Unix()}, nil},
+		{"'bundle.maxAge'='0'", &Chain{Timestamp: now.AddDate(-1, 0, 0).Unix()}, nil},
+		{"'bundle.maxAge'='7'", &Chain{Timestamp: now.AddDate(0, 0, -6).Unix()}, nil},
+		{"'bundle.maxAge'='7'", &Chain{Timestamp: now.AddDate(0, 0, -8).Unix()}, ErrFrozen},
+		{"'bundle.maxAge'='7'", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Setenv("GIT_CONFIG_PARAMETERS", test.config)
+
+		err := checkFreeze(test.chain)
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("%q: expected %v, got %v", test.config, test.err, err)
+		}
+	}
+}
+
+func TestCheckBase(t *testing.T) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	err := checkBase(path, &Chain{Repository: "r", Version: 1, Base: "a"})
+	if err != nil {
+		t.Fatalf("missing state: %v", err)
+	}
+
+	err = writeState(path, &State{Repository: "r", Version: 3, Hash: "c", Base: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		chain *Chain
+		allow bool
+		err   error
+	}{
+		{"same base", &Chain{Repository: "r", Version: 1, Base: "a"}, false, nil},
+		{"new base", &Chain{Repository: "r", Version: 4, Base: "d"}, false, nil},
+		{"old base", &Chain{Repository: "r", Version: 2, Base: "b"}, false, ErrRollback},
+		{"replaced base", &Chain{Repository: "r", Version: 3, Base: "d"}, false, ErrRollback},
+		{"allowed rollback", &Chain{Repository: "r", Version: 2, Base: "b"}, true, nil},
+		{"other repository", &Chain{Repository: "s", Version: 4, Base: "d"}, false, ErrRepositoryMismatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.allow {
+				t.Setenv("GIT_CONFIG_PARAMETERS", "'bundle.allowRollback'='true'")
+			}
+
+			err := checkBase(path, test.chain)
+			if test.err == nil && err != nil {
+				t.Fatal(err)
+			}
+
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	state, err := readState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Version != 3 || state.Base != "a" {
+		t.Errorf("the state was modified: %+v", state)
+	}
+}
@@ -0,0 +1,370 @@
+package git
+
+import (
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/illikainen/git-remote-bundle/src/metadata"
+
+	"github.com/illikainen/go-cryptor/src/blob"
+	"github.com/illikainen/go-netutils/src/transport"
+	"github.com/illikainen/go-utils/src/errorx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// A URL of a remote together with what was learned about it when the URLs of
+// the remote were probed.
+type candidate struct {
+	uri *url.URL
+
+	// Verified manifest and the chain that it describes.  Nil if the URL
+	// doesn't have an up-to-date manifest.
+	manifest *Manifest
+	chain    *Chain
+
+	// Whether the remote doesn't exist at the URL.
+	missing bool
+}
+
+var ErrOutOfSync = errors.New("the URL has diverged from the other URLs of the remote")
+
+// Probe every URL of the remote and order them by preference.
+//
+// URLs with an up-to-date manifest come first with the newest version first,
+// followed by URLs without a usable manifest and finally by URLs where the
+// remote doesn't exist.  URLs that are equally preferable keep their configured
+// order.  URLs that can't be probed are skipped.
+func probeURLs(r *remote) ([]*candidate, error) {
+	candidates := []*candidate{}
+	errs := []error{}
+
+	for _, uri := range r.uris {
+		c, err := probeURL(r, uri)
+		if err != nil {
+			if len(r.uris) > 1 {
+				log.Warnf("skipping %s: %v", uri, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	if len(candidates) == 0 {
+		return nil, errorx.Join(errs...)
+	}
+
+	sortCandidates(candidates)
+	return candidates, nil
+}
+
+// Order `candidates` by preference.  See probeURLs.
+func sortCandidates(candidates []*candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a := candidates[i]
+		b := candidates[j]
+
+		if (a.manifest != nil) != (b.manifest != nil) {
+			return a.manifest != nil
+		}
+
+		if a.manifest != nil {
+			return a.manifest.Version > b.manifest.Version
+		}
+
+		return !a.missing && b.missing
+	})
+}
+
+func probeURL(r *remote, uri *url.URL) (*candidate, error) {
+	err := r.fetchRevocations(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, chain, err := remoteManifest(r, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &candidate{uri: uri, manifest: manifest, chain: chain}
+	if manifest == nil {
+		hash, err := r.remoteHash(uri)
+		if err != nil {
+			return nil, err
+		}
+		c.missing = hash == ""
+	}
+
+	return c, nil
+}
+
+// Bring the mirror up to date with the first candidate that can be verified.
+//
+// The remote is only treated as missing if it doesn't exist at any of its
+// URLs.
+func syncCandidates(r *remote, candidates []*candidate, allowMissing bool, tmpDir string) (*Mirror,
+	*Chain, error) {
+	missing := 0
+	errs := []error{}
+
+	for i, c := range candidates {
+		r.uri = c.uri
+
+		mirror, chain, err := syncRemote(r, false, tmpDir)
+		if err == nil {
+			return mirror, chain, nil
+		}
+
+		if errors.Is(err, transport.ErrNotExist) {
+			missing++
+		} else if i < len(candidates)-1 {
+			log.Warnf("unable to fetch %s, trying the next URL: %v", c.uri, err)
+		}
+		errs = append(errs, err)
+	}
+
+	if allowMissing && missing == len(r.uris) {
+		r.uri = r.uris[0]
+		return syncRemote(r, true, tmpDir)
+	}
+
+	return nil, nil, errorx.Join(errs...)
+}
+
+// Upload the sealed bundle described by `hdr` and its push record in `record`
+// to every URL of the remote.
+//
+// The bundle is uploaded to the URLs that are unchanged since `chain` was
+// downloaded.  URLs that were behind when they were probed (or that don't
+// have the remote yet) first get a copy of the bundles in `chain`, so that
+// every URL ends up with the same bundles.  Other URLs are left as-is and
+// reported as failed.
+//
+// The push is rejected before anything is uploaded if the URL that `chain`
+// was downloaded from has changed.
+//
+// The current chain is kept as a generation when a full bundle replaces it
+// if `rotate` is true.
+func uploadBundle(r *remote, candidates []*candidate, repo string, chain *Chain, hdr *Header,
+	sealed *os.File, record *os.File, pushed *Chain, rotate bool) error {
+	err := checkRemote(r, r.uri, chain)
+	if err != nil {
+		return err
+	}
+
+	replicate := map[*url.URL]bool{}
+	errs := map[*url.URL]error{}
+
+	for _, uri := range r.uris {
+		if uri == r.uri {
+			continue
+		}
+
+		diff, err := diffRemote(r, uri, chain)
+		if err != nil {
+			errs[uri] = err
+			continue
+		}
+
+		if diff == "" {
+			continue
+		}
+
+		replicate[uri], err = isBehind(r, uri, candidates, chain)
+		if err != nil {
+			errs[uri] = err
+		} else if !replicate[uri] {
+			errs[uri] = errors.Wrap(ErrOutOfSync, diff)
+		}
+	}
+
+	updated := 0
+	for _, uri := range r.uris {
+		err := errs[uri]
+		if err == nil {
+			err = uploadTo(r, uri, repo, replicate[uri], hdr, sealed, record, pushed, rotate)
+		}
+
+		if err != nil {
+			log.Errorf("failed to update %s: %v", uri, err)
+			errs[uri] = err
+			continue
+		}
+
+		log.Infof("updated %s to version %d", uri, hdr.Version)
+		updated++
+	}
+
+	if updated == 0 {
+		return errors.Errorf("unable to update any URL of the remote")
+	}
+
+	if len(r.uris) > 1 {
+		log.Infof("updated %d of %d URLs", updated, len(r.uris))
+	}
+
+	return nil
+}
+
+// Whether `uri` was behind `chain` when it was probed and hasn't changed
+// since.
+func isBehind(r *remote, uri *url.URL, candidates []*candidate, chain *Chain) (bool, error) {
+	for _, c := range candidates {
+		if c.uri != uri {
+			continue
+		}
+
+		var probed *Chain
+		switch {
+		case c.missing:
+			probed = nil
+		case c.chain != nil && chain != nil && c.chain.Version < chain.Version:
+			probed = c.chain
+		default:
+			return false, nil
+		}
+
+		diff, err := diffRemote(r, uri, probed)
+		if err != nil {
+			return false, err
+		}
+		return diff == "", nil
+	}
+
+	return false, nil
+}
+
+func uploadTo(r *remote, uri *url.URL, repo string, replicate bool, hdr *Header, sealed *os.File,
+	record *os.File, pushed *Chain, rotate bool) error {
+	opts := &blob.Options{
+		Type:      metadata.Name(),
+		Keyring:   r.keys,
+		Encrypted: Encrypt(),
+	}
+
+	if hdr.Index == 0 {
+		// The full bundle is about to be replaced, so the current
+		// chain is kept as a generation.
+		if hdr.Parent != "" && rotate {
+			err := rotateGenerations(r, uri)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := blob.Upload(uri, sealed, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		if replicate {
+			r.progressf("copying the chain to %s", uri)
+			err := replicateChain(r, uri, pushed, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := blob.Upload(incrementalURL(uri, hdr.Index), sealed, opts)
+		if err != nil {
+			return err
+		}
+
+		// The full bundle is uploaded last so that the new incremental
+		// bundles are ignored by readers until the chain is complete.
+		if replicate {
+			err := blob.Upload(uri, r.bundleFile, opts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := blob.Upload(recordURL(uri, hdr.Version), record, recordOptions(r.keys))
+	if err != nil {
+		return err
+	}
+
+	// Incremental bundles from a previous chain may occupy the position
+	// after the new tip.
+	next, err := r.remoteHash(incrementalURL(uri, hdr.Index+1))
+	if err != nil {
+		return err
+	}
+
+	if uri == r.uri {
+		pushed.Next = next
+	}
+
+	manifest := *pushed
+	manifest.Next = next
+	return uploadManifest(r, uri, repo, &manifest)
+}
+
+// Upload the cached incremental bundles that precede the tip of `pushed` to
+// `uri`.
+//
+// The cached bundles are verified to link up with the full bundle and the new
+// tip before anything is uploaded.
+func replicateChain(r *remote, uri *url.URL, pushed *Chain, opts *blob.Options) (err error) {
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			errorx.Defer(f.Close, &err)
+		}
+	}()
+
+	for i := 1; i <= pushed.Length; i++ {
+		f, err := incrementalFile(r.bundleFile, i)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	expected := pushed.Tip
+	for i := pushed.Length; i >= 1; i-- {
+		bundle, err := blob.NewReader(files[i-1], opts)
+		if err != nil {
+			return err
+		}
+
+		if bundle.Metadata.Hashes.SHA256 != expected {
+			return errors.Errorf("%s: expected '%s', got '%s'", files[i-1].Name(), expected,
+				bundle.Metadata.Hashes.SHA256)
+		}
+
+		hdr, err := blobHeader(bundle)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Index != i || hdr.Base != pushed.Base {
+			return errors.Errorf("%s: the cached bundle isn't part of the chain", files[i-1].Name())
+		}
+		expected = hdr.Parent
+	}
+
+	base, err := blob.NewReader(r.bundleFile, opts)
+	if err != nil {
+		return err
+	}
+
+	if base.Metadata.Hashes.SHA256 != expected || expected != pushed.Base {
+		return errors.Errorf("%s: expected '%s', got '%s'", r.bundleFile.Name(), expected,
+			base.Metadata.Hashes.SHA256)
+	}
+
+	for i := 1; i < pushed.Length; i++ {
+		err := blob.Upload(incrementalURL(uri, i), files[i-1], opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
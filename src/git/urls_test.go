@@ -0,0 +1,36 @@
+package git
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSortCandidates(t *testing.T) {
+	newCandidate := func(name string, version uint64, manifest bool, missing bool) *candidate {
+		c := &candidate{uri: &url.URL{Scheme: "file", Path: "/" + name}, missing: missing}
+		if manifest {
+			c.manifest = &Manifest{Version: version}
+		}
+		return c
+	}
+
+	candidates := []*candidate{
+		newCandidate("missing1", 0, false, true),
+		newCandidate("stale1", 0, false, false),
+		newCandidate("v1", 1, true, false),
+		newCandidate("missing2", 0, false, true),
+		newCandidate("v3a", 3, true, false),
+		newCandidate("stale2", 0, false, false),
+		newCandidate("v3b", 3, true, false),
+		newCandidate("v2", 2, true, false),
+	}
+
+	sortCandidates(candidates)
+
+	expected := []string{"/v3a", "/v3b", "/v2", "/v1", "/stale1", "/stale2", "/missing1", "/missing2"}
+	for i, c := range candidates {
+		if c.uri.Path != expected[i] {
+			t.Errorf("%d: expected %s, got %s", i, expected[i], c.uri.Path)
+		}
+	}
+}